@@ -7,12 +7,14 @@ import (
 	"net/http"
 	"os"
 	"strconv"
+	"strings"
 	"time"
+	"unicode"
 
     _ "week11-assignment/docs"
 
 	"github.com/gin-gonic/gin"
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -54,6 +56,29 @@ type ErrorResponse struct {
     UpdatedAt      time.Time `json:"updated_at"`
 }
 
+type BookSearchResult struct {
+	Book
+	Rank     float64 `json:"rank"`
+	Headline string  `json:"headline"` // ส่วนของ description ที่ตรงกับคำค้น ครอบด้วย <mark>
+}
+
+type BookSearchResponse struct {
+	Data  []BookSearchResult `json:"data"`
+	Page  int                `json:"page"`
+	Limit int                `json:"limit"`
+	Total int                `json:"total"`
+
+	// true = ไม่เจอแบบตรงตัว ผลลัพธ์มาจาก trigram similarity
+	Fuzzy      bool   `json:"fuzzy"`
+	Suggestion string `json:"suggestion,omitempty"` // "did you mean"
+}
+
+type BookSuggestion struct {
+	Type   string `json:"type"` // "title" หรือ "author"
+	Value  string `json:"value"`
+	BookID int    `json:"book_id,omitempty"` // มีเฉพาะ type = "title"
+}
+
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
 		return value
@@ -61,6 +86,13 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+func getEnvFloat(key string, defaultValue float64) float64 {
+	if value, err := strconv.ParseFloat(os.Getenv(key), 64); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
 var db *sql.DB
 
 func initDB() {
@@ -403,49 +435,352 @@ func getCategories(c *gin.Context) {
 	c.JSON(http.StatusOK, categories)
 }
 
+// ===================== Search =====================
+const (
+	headlineStart = "<mark>"
+	headlineStop  = "</mark>"
+)
+
+// word_similarity ขั้นต่ำของ fuzzy search (0-1, ยิ่งต่ำยิ่งทนคำผิดได้มากแต่ผลจะหลวมขึ้น)
+var searchSimilarityThreshold = getEnvFloat("SEARCH_SIMILARITY_THRESHOLD", 0.4)
+
+// ภาษาไทยไม่เว้นวรรคระหว่างคำ tsvector จึงเก็บทั้งวลีเป็น lexeme เดียว ค้นด้วยคำย่อยไม่เจอ
+func containsThai(s string) bool {
+	for _, r := range s {
+		if unicode.Is(unicode.Thai, r) {
+			return true
+		}
+	}
+	return false
+}
+
+// แยกคำค้นตามช่องว่าง: คำที่มีอักษรไทยต้องค้นแบบ substring ส่วนคำที่เหลือยังใช้ full-text ได้
+// เช่น "python เบื้องต้น" -> thai = [เบื้องต้น], other = "python"
+func splitThaiQuery(q string) ([]string, string) {
+	var thai, other []string
+	for _, word := range strings.Fields(q) {
+		if containsThai(word) {
+			thai = append(thai, word)
+		} else {
+			other = append(other, word)
+		}
+	}
+	return thai, strings.Join(other, " ")
+}
+
+// escape ตัวอักษรพิเศษของ LIKE ให้คำค้นถูกตีความตามตัวอักษร
+var likeEscaper = strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`)
+
+func likePattern(q string) string {
+	return "%" + likeEscaper.Replace(q) + "%"
+}
+
+// ตัด description รอบตำแหน่งแรกที่เจอคำค้น (ใช้กับคำค้นภาษาไทยแทน ts_headline)
+func highlightSnippet(text, q string, radius int) string {
+	runes := []rune(text)
+	lower := []rune(strings.ToLower(text))
+	needle := []rune(strings.ToLower(q))
+	if len(lower) != len(runes) { // ToLower เปลี่ยนจำนวน rune ได้ในบางภาษา ตำแหน่งจะเพี้ยน
+		lower, needle = runes, []rune(q)
+	}
+
+	start := -1
+	for i := 0; i+len(needle) <= len(lower); i++ {
+		if string(lower[i:i+len(needle)]) == string(needle) {
+			start = i
+			break
+		}
+	}
+	if start < 0 {
+		if len(runes) > radius*2 {
+			return string(runes[:radius*2]) + "…"
+		}
+		return text
+	}
+
+	end := start + len(needle)
+	from, to := max(start-radius, 0), min(end+radius, len(runes))
+	snippet := string(runes[from:start]) + headlineStart + string(runes[start:end]) + headlineStop + string(runes[end:to])
+	if from > 0 {
+		snippet = "…" + snippet
+	}
+	if to < len(runes) {
+		snippet += "…"
+	}
+	return snippet
+}
+
+// เงื่อนไขค้นหาหนึ่งแบบ: match/rank ใช้ใน WHERE/ORDER BY ส่วน headline คำนวณหลัง LIMIT เฉพาะแถวที่ส่งกลับ
+type bookSearch struct {
+	match     string
+	rank      string
+	headline  string
+	args      []interface{} // $1, $2, ... ที่ match/rank/headline อ้างถึง (LIMIT/OFFSET ต่อท้าย)
+	snippet   bool          // true = headline ทำใน Go ด้วย highlightSnippet
+	highlight string        // คำที่ highlightSnippet ครอบ <mark>
+}
+
+// *sql.DB หรือ *sql.Tx (fuzzy search ต้องตั้งค่า pg_trgm ใน transaction เดียวกัน)
+type queryer interface {
+	Query(query string, args ...interface{}) (*sql.Rows, error)
+	QueryRow(query string, args ...interface{}) *sql.Row
+}
+
+func fullTextSearch(q string) bookSearch {
+	// english ใช้กับ title/description ที่ถูก stem, simple ใช้กับชื่อผู้แต่ง
+	tsquery := "(websearch_to_tsquery('english', $1) || websearch_to_tsquery('simple', $1))"
+	return bookSearch{
+		match: "b.search_vector @@ " + tsquery,
+		rank:  "ts_rank_cd(b.search_vector, " + tsquery + ")",
+		headline: fmt.Sprintf(
+			"ts_headline('english', coalesce(r.description, ''), %s, 'StartSel=%s, StopSel=%s, MinWords=10, MaxWords=30, MaxFragments=2')",
+			tsquery, headlineStart, headlineStop,
+		),
+		args: []interface{}{q},
+	}
+}
+
+// คำไทยทุกคำต้องอยู่ใน title/author/description (ILIKE ALL) โดยกรองด้วย search_trigrams (GIN) ก่อน
+// trigram ของคำค้นคำนวณด้วย char_trigrams ใน DB เพื่อให้ lower() ตรงกับตอนสร้าง index
+// คำที่ไม่ใช่ไทยในคำค้นเดียวกันต้อง match full-text ด้วย (ถ้าเป็น stop word ล้วนจะถูกข้าม)
+func thaiSearch(q string) bookSearch {
+	thai, other := splitThaiQuery(q)
+	patterns := make([]string, len(thai))
+	for i, word := range thai {
+		patterns[i] = likePattern(word)
+	}
+
+	search := bookSearch{
+		match: `(b.search_trigrams @> (SELECT coalesce(array_agg(g), '{}') FROM unnest($1::text[]) AS t, unnest(char_trigrams(t)) AS g)
+			AND (coalesce(b.title, '') || ' ' || coalesce(b.author, '') || ' ' || coalesce(b.description, '')) ILIKE ALL($2))`,
+		// น้ำหนักเดียวกับ ts_rank ค่า default (A=1.0, B=0.4, C=0.2)
+		rank: `(CASE WHEN b.title ILIKE ALL($2) THEN 1.0 ELSE 0 END +
+			CASE WHEN b.author ILIKE ALL($2) THEN 0.4 ELSE 0 END +
+			CASE WHEN b.description ILIKE ALL($2) THEN 0.2 ELSE 0 END)`,
+		headline:  "coalesce(r.description, '')",
+		args:      []interface{}{pq.Array(thai), pq.Array(patterns)},
+		snippet:   true,
+		highlight: thai[0],
+	}
+	if other != "" {
+		tsquery := "(websearch_to_tsquery('english', $3) || websearch_to_tsquery('simple', $3))"
+		search.match += " AND (numnode(" + tsquery + ") = 0 OR b.search_vector @@ " + tsquery + ")"
+		search.rank += " + ts_rank_cd(b.search_vector, " + tsquery + ")"
+		search.args = append(search.args, other)
+	}
+	return search
+}
+
+// พิมพ์ผิด: เทียบ trigram กับ title/author (<% ใช้ GIN trigram index ได้ และตัดด้วย word_similarity_threshold)
+// pg_trgm ไม่ได้ trigram ที่ใช้ได้จากข้อความไทย (ดู migration3) fallback นี้จึงช่วยได้เฉพาะคำภาษาอังกฤษ
+func fuzzySearch(q string) bookSearch {
+	return bookSearch{
+		match:    "($1 <% b.title OR $1 <% b.author)",
+		rank:     "GREATEST(word_similarity($1, b.title), word_similarity($1, coalesce(b.author, '')))",
+		headline:  "coalesce(r.description, '')",
+		args:      []interface{}{q},
+		snippet:   true,
+		highlight: q,
+	}
+}
+
+func (s bookSearch) run(tx queryer, limit, offset int) ([]BookSearchResult, int, error) {
+	rows, err := tx.Query(fmt.Sprintf(`
+		SELECT r.id, r.title, r.author, r.isbn, r.year, r.price, r.category, r.created_at, r.updated_at,
+		       r.rank, %s, r.total
+		FROM (
+			SELECT b.*, %s AS rank, COUNT(*) OVER () AS total
+			FROM books b
+			WHERE %s
+			ORDER BY rank DESC, b.rating DESC, b.id
+			LIMIT $%d OFFSET $%d
+		) r
+		ORDER BY r.rank DESC, r.rating DESC, r.id
+	`, s.headline, s.rank, s.match, len(s.args)+1, len(s.args)+2), append(s.args, limit, offset)...)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer rows.Close()
+
+	results := []BookSearchResult{}
+	total := 0
+	for rows.Next() {
+		var result BookSearchResult
+		if err := rows.Scan(&result.ID, &result.Title, &result.Author, &result.ISBN, &result.Year, &result.Price, &result.Category, &result.CreatedAt, &result.UpdatedAt,
+			&result.Rank, &result.Headline, &total); err != nil {
+			return nil, 0, err
+		}
+		if s.snippet {
+			result.Headline = highlightSnippet(result.Headline, s.highlight, 60)
+		}
+		results = append(results, result)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, 0, err
+	}
+
+	// หน้าที่เกินจำนวนผลลัพธ์จะไม่มีแถวให้อ่าน total จึงต้องนับแยก
+	if len(results) == 0 && offset > 0 {
+		if err := tx.QueryRow("SELECT COUNT(*) FROM books b WHERE "+s.match, s.args...).Scan(&total); err != nil {
+			return nil, 0, err
+		}
+	}
+	return results, total, nil
+}
+
+// "did you mean": แทนแต่ละคำในคำค้นด้วยคำที่ใกล้ที่สุดจาก title/author ของหนังสือที่ใกล้เคียงที่สุด
+func didYouMean(tx queryer, q string) (string, error) {
+	var suggestion sql.NullString
+	err := tx.QueryRow(`
+		WITH candidates AS (
+			SELECT b.title, b.author
+			FROM books b
+			WHERE $1 <% b.title OR $1 <% b.author
+			ORDER BY GREATEST(word_similarity($1, b.title), word_similarity($1, coalesce(b.author, ''))) DESC
+			LIMIT 10
+		), words AS (
+			SELECT DISTINCT w
+			FROM candidates, regexp_split_to_table(coalesce(candidates.title, '') || ' ' || coalesce(candidates.author, ''), '[\s,.:;!?()"]+') AS w
+			WHERE w <> ''
+		)
+		SELECT string_agg(coalesce(best.w, q.qw), ' ' ORDER BY q.ord)
+		FROM regexp_split_to_table($1, '\s+') WITH ORDINALITY AS q(qw, ord)
+		LEFT JOIN LATERAL (
+			SELECT w FROM words
+			WHERE similarity(w, q.qw) >= $2
+			ORDER BY similarity(w, q.qw) DESC
+			LIMIT 1
+		) best ON true
+	`, q, searchSimilarityThreshold).Scan(&suggestion)
+	if err != nil || !suggestion.Valid || strings.EqualFold(suggestion.String, q) {
+		return "", err
+	}
+	return suggestion.String, nil
+}
+
 // @Summary Search books
-// @Description Search books by title, author, or description
+// @Description Full-text search by title, author, or description ranked by relevance.
+// @Description Words containing Thai characters are matched as substrings; other words in the same query still use full-text search.
+// @Description When nothing matches, falls back to trigram similarity on title/author and returns a "did you mean" suggestion.
 // @Tags Books
 // @Produce json
 // @Param q query string true "Search keyword"
-// @Success 200 {array} Book
+// @Param page query int false "Page number (default 1)"
+// @Param limit query int false "Results per page (default 20, max 100)"
+// @Success 200 {object} BookSearchResponse
 // @Failure 400 {object} ErrorResponse
 // @Failure 500 {object} ErrorResponse
 // @Router /books/search [get]
 func searchBooks(c *gin.Context) {
-	q := c.Query("q")
+	q := strings.TrimSpace(c.Query("q"))
 	if q == "" {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "missing query parameter q"})
 		return
 	}
-	pattern := "%" + q + "%"
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	offset := (page - 1) * limit
+
+	search := fullTextSearch(q)
+	if containsThai(q) {
+		search = thaiSearch(q)
+	}
+
+	results, total, err := search.run(db, limit, offset)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	response := BookSearchResponse{Data: results, Page: page, Limit: limit, Total: total}
 
+	// ไม่เจอเลย: ลองแบบทนคำผิด (set_config แบบ local มีผลเฉพาะใน transaction นี้)
+	if total == 0 {
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		threshold := strconv.FormatFloat(searchSimilarityThreshold, 'f', -1, 64)
+		if _, err := tx.Exec("SELECT set_config('pg_trgm.word_similarity_threshold', $1, true)", threshold); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if response.Data, response.Total, err = fuzzySearch(q).run(tx, limit, offset); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		response.Fuzzy = true
+		if response.Suggestion, err = didYouMean(tx, q); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// @Summary Autocomplete books
+// @Description Title and author prefix suggestions for the search box
+// @Tags Books
+// @Produce json
+// @Param q query string true "Prefix typed so far"
+// @Param limit query int false "Suggestions per type (default 5, max 20)"
+// @Success 200 {array} BookSuggestion
+// @Failure 500 {object} ErrorResponse
+// @Router /books/suggest [get]
+func suggestBooks(c *gin.Context) {
+	q := strings.TrimSpace(c.Query("q"))
+	if q == "" {
+		c.JSON(http.StatusOK, []BookSuggestion{})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "5"))
+	if limit < 1 || limit > 20 {
+		limit = 5
+	}
+
+	// LIKE prefix กับ COLLATE "C" ใช้ btree index (lower(...) COLLATE "C") ได้ อ่านแค่แถวต้นๆ ของช่วง prefix
+	prefix := likeEscaper.Replace(strings.ToLower(q)) + "%"
 	rows, err := db.Query(`
-		SELECT id, title, author, isbn, year, price, category, created_at, updated_at
-		FROM books
-		WHERE title ILIKE $1 OR author ILIKE $1 OR description ILIKE $1
-		ORDER BY rating DESC, reviews_count DESC, created_at DESC
-		LIMIT 20
-	`, pattern)
+		(SELECT DISTINCT ON (lower(title) COLLATE "C") 'title', title, id
+		 FROM books
+		 WHERE lower(title) COLLATE "C" LIKE $1
+		 ORDER BY lower(title) COLLATE "C", id
+		 LIMIT $2)
+		UNION ALL
+		(SELECT DISTINCT ON (lower(author) COLLATE "C") 'author', author, 0
+		 FROM books
+		 WHERE lower(author) COLLATE "C" LIKE $1
+		 ORDER BY lower(author) COLLATE "C"
+		 LIMIT $2)
+	`, prefix, limit)
 	if err != nil {
 		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 	defer rows.Close()
 
-	var books []Book
+	suggestions := []BookSuggestion{}
 	for rows.Next() {
-		var book Book
-		if err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.Year, &book.Price, &book.Category, &book.CreatedAt, &book.UpdatedAt); err != nil {
+		var s BookSuggestion
+		if err := rows.Scan(&s.Type, &s.Value, &s.BookID); err != nil {
 			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-		books = append(books, book)
+		suggestions = append(suggestions, s)
 	}
-	if books == nil {
-		books = []Book{}
-	}
-	c.JSON(http.StatusOK, books)
+
+	// ผลเปลี่ยนไม่บ่อย ให้ browser/CDN cache ช่วยลดจำนวน request ขณะพิมพ์
+	c.Header("Cache-Control", "public, max-age=60")
+	c.JSON(http.StatusOK, suggestions)
 }
 
 // @Summary Get featured books
@@ -557,6 +892,7 @@ func main() {
 		api.GET("/books/featured", getFeaturedBooks)
 		api.GET("/books/discounted", getDiscountedBooks)
 		api.GET("/books/search", searchBooks)
+		api.GET("/books/suggest", suggestBooks)
 		api.GET("/books/:id", getBook)
 		api.POST("/books", createBook)
 		api.PUT("/books/:id", updateBook)
@@ -0,0 +1,19 @@
+-- 1. Full-text Search (books)
+CREATE EXTENSION IF NOT EXISTS pg_trgm;
+
+-- น้ำหนัก: title (A) > author (B) > description (C)
+-- title/description ใช้ 'english' (stem คำอังกฤษ เช่น learning -> learn)
+-- author ใช้ 'simple' ชื่อคนไม่ควรถูก stem
+-- คำไทยผ่าน parser ได้แต่ไม่ถูกตัดคำ (ไทยไม่เว้นวรรค) จึงได้เป็นทั้งวลี คำค้นไทยใช้ substring แทน (ดู migration3)
+ALTER TABLE books ADD COLUMN search_vector tsvector GENERATED ALWAYS AS (
+    setweight(to_tsvector('english', coalesce(title, '')), 'A') ||
+    setweight(to_tsvector('simple', coalesce(author, '')), 'B') ||
+    setweight(to_tsvector('english', coalesce(description, '')), 'C')
+) STORED;
+
+CREATE INDEX idx_books_search_vector ON books USING GIN (search_vector);
+
+-- trigram index สำหรับ fuzzy search (พิมพ์ผิด) ซึ่งได้ผลกับคำภาษาอังกฤษเท่านั้น
+-- ข้อความไทยไม่ได้ trigram ที่ใช้ได้จาก pg_trgm (ดูเหตุผลใน migration3)
+CREATE INDEX idx_books_title_trgm ON books USING GIN (title gin_trgm_ops);
+CREATE INDEX idx_books_author_trgm ON books USING GIN (author gin_trgm_ops);
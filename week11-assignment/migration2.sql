@@ -0,0 +1,7 @@
+-- 2. Typo-tolerant Search / Autocomplete
+-- fuzzy search (<%, word_similarity) ใช้ trigram index บน title/author จาก migration1 ได้เลย
+
+-- autocomplete แบบ prefix: btree บน lower(...) collation "C" ใช้ได้ทั้ง LIKE 'คำ%' และ ORDER BY
+-- (index ที่ collation ไม่ใช่ C ใช้กับ LIKE prefix ไม่ได้)
+CREATE INDEX idx_books_title_prefix ON books ((lower(title) COLLATE "C"));
+CREATE INDEX idx_books_author_prefix ON books ((lower(author) COLLATE "C"));
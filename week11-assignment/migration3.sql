@@ -0,0 +1,16 @@
+-- 3. Thai Substring Search
+-- pg_trgm ตัด trigram จาก "คำ" ที่เป็นตัวอักษร/ตัวเลขตาม locale ของฐานข้อมูลเท่านั้น จึงใช้กับภาษาไทยไม่ได้
+--   - locale C: อักษรไทยไม่ถูกนับเป็นตัวอักษรเลย ข้อความไทยไม่มี trigram สักตัว
+--   - locale อื่น: สระ/วรรณยุกต์ที่เป็น combining mark (ั ิ ี ่ ้ ฯลฯ) ไม่ถูกนับ คำจึงขาดตรงนั้น trigram ไม่ตรงกับคำค้น
+-- ที่นี่จึงสร้าง trigram เองโดยนับทุกตัวอักษร (ไม่ขึ้นกับ locale) ใช้ GIN กรองแถวก่อน แล้วค่อยเช็ค ILIKE จริง
+CREATE FUNCTION char_trigrams(t text) RETURNS text[]
+LANGUAGE sql IMMUTABLE PARALLEL SAFE AS $$
+    SELECT coalesce(array_agg(DISTINCT substr(lower(t), i, 3)), '{}')
+    FROM generate_series(1, char_length(t) - 2) AS i
+$$;
+
+ALTER TABLE books ADD COLUMN search_trigrams text[] GENERATED ALWAYS AS (
+    char_trigrams(coalesce(title, '') || ' ' || coalesce(author, '') || ' ' || coalesce(description, ''))
+) STORED;
+
+CREATE INDEX idx_books_search_trigrams ON books USING GIN (search_trigrams);
@@ -0,0 +1,72 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestLikePattern(t *testing.T) {
+	tests := []struct {
+		in, want string
+	}{
+		{"golang", "%golang%"},
+		{"เขียนโปรแกรม", "%เขียนโปรแกรม%"},
+		{"50%", `%50\%%`},
+		{"snake_case", `%snake\_case%`},
+		{`C:\books`, `%C:\\books%`},
+		{"", "%%"},
+	}
+
+	for _, tt := range tests {
+		if got := likePattern(tt.in); got != tt.want {
+			t.Errorf("likePattern(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestHighlightSnippet(t *testing.T) {
+	tests := []struct {
+		name   string
+		text   string
+		q      string
+		radius int
+		want   string
+	}{
+		{"match at start", "Go programming basics", "go", 5, "<mark>Go</mark> prog…"},
+		{"match in middle", "abcdefghij", "ef", 2, "…cd<mark>ef</mark>gh…"},
+		{"case insensitive", "Learn GOLANG", "golang", 100, "Learn <mark>GOLANG</mark>"},
+		{"thai", "การเขียนโปรแกรมภาษาไทย", "โปรแกรม", 3, "…ียน<mark>โปรแกรม</mark>ภาษ…"},
+		{"no match short text", "short", "zz", 10, "short"},
+		{"no match long text", "abcdefghij", "zz", 2, "abcd…"},
+		{"empty text", "", "go", 5, ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := highlightSnippet(tt.text, tt.q, tt.radius); got != tt.want {
+				t.Errorf("highlightSnippet(%q, %q, %d) = %q, want %q", tt.text, tt.q, tt.radius, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestSplitThaiQuery(t *testing.T) {
+	tests := []struct {
+		q         string
+		wantThai  []string
+		wantOther string
+	}{
+		{"python เบื้องต้น", []string{"เบื้องต้น"}, "python"},
+		{"  เขียน   โปรแกรม ", []string{"เขียน", "โปรแกรม"}, ""},
+		{"learn go", nil, "learn go"},
+		{"Pythonเบื้องต้น", []string{"Pythonเบื้องต้น"}, ""},
+		{"go เบื้องต้น web", []string{"เบื้องต้น"}, "go web"},
+	}
+
+	for _, tt := range tests {
+		thai, other := splitThaiQuery(tt.q)
+		if !reflect.DeepEqual(thai, tt.wantThai) || other != tt.wantOther {
+			t.Errorf("splitThaiQuery(%q) = (%q, %q), want (%q, %q)", tt.q, thai, other, tt.wantThai, tt.wantOther)
+		}
+	}
+}
@@ -2,17 +2,30 @@ package main
 
 import (
 	"crypto/rand"
+	"database/sql"
 	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"log"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
+	"github.com/lib/pq"
 )
 
 // Server-side session storage
-type SessionStore struct {
-    sessions map[string]*SessionData
-    mu       sync.RWMutex
+// เลือก backend ได้ผ่าน SESSION_STORE=memory (default) หรือ postgres
+type SessionStore interface {
+	// สร้าง session ใหม่ด้วย ID แบบสุ่ม
+	Create(data SessionData) (string, error)
+	// ดึง session ที่ยังไม่หมดอายุ พร้อมต่ออายุ idle timeout (sliding) ในขั้นตอนเดียว
+	Get(sessionID string) (SessionData, error)
+	Delete(sessionID string) error
+	// ลบ session ที่หมดอายุแล้ว คืนจำนวนที่ลบ
+	DeleteExpired() (int, error)
 }
 
 type SessionData struct {
@@ -23,8 +36,246 @@ type SessionData struct {
     LastAccess  time.Time
 }
 
-var store = &SessionStore{
-    sessions: make(map[string]*SessionData),
+var ErrSessionNotFound = errors.New("session not found")
+
+// absolute: อายุสูงสุดนับจาก login (ต่ออายุไม่ได้)
+// idle: ไม่มี request เกินเวลานี้ถือว่าหมดอายุ (ต่ออายุทุกครั้งที่ใช้)
+type SessionTimeouts struct {
+	Absolute time.Duration
+	Idle     time.Duration
+}
+
+func (t SessionTimeouts) expired(s SessionData, now time.Time) bool {
+	return now.Sub(s.CreatedAt) >= t.Absolute || now.Sub(s.LastAccess) >= t.Idle
+}
+
+// อายุ cookie ที่เหลือ = ค่าที่น้อยกว่าระหว่าง idle กับเวลาที่เหลือของ absolute
+func (t SessionTimeouts) remaining(s SessionData, now time.Time) time.Duration {
+	remaining := t.Absolute - now.Sub(s.CreatedAt)
+	if t.Idle < remaining {
+		return t.Idle
+	}
+	return remaining
+}
+
+// ===================== In-memory Store =====================
+// แบ่ง map เป็นหลาย shard ลดการแย่ง lock และแก้ LastAccess ภายใต้ lock เดียวกับตอนอ่าน
+const sessionShardCount = 32
+
+type memoryShard struct {
+	mu       sync.Mutex
+	sessions map[string]*SessionData
+}
+
+type MemorySessionStore struct {
+	shards   [sessionShardCount]*memoryShard
+	timeouts SessionTimeouts
+}
+
+func NewMemorySessionStore(timeouts SessionTimeouts) *MemorySessionStore {
+	s := &MemorySessionStore{timeouts: timeouts}
+	for i := range s.shards {
+		s.shards[i] = &memoryShard{sessions: make(map[string]*SessionData)}
+	}
+	return s
+}
+
+func (s *MemorySessionStore) shard(sessionID string) *memoryShard {
+	h := fnv.New32a()
+	h.Write([]byte(sessionID))
+	return s.shards[h.Sum32()%sessionShardCount]
+}
+
+func (s *MemorySessionStore) Create(data SessionData) (string, error) {
+	sessionID, err := generateRandomID()
+	if err != nil {
+		return "", err
+	}
+
+	sh := s.shard(sessionID)
+	sh.mu.Lock()
+	sh.sessions[sessionID] = &data
+	sh.mu.Unlock()
+	return sessionID, nil
+}
+
+func (s *MemorySessionStore) Get(sessionID string) (SessionData, error) {
+	sh := s.shard(sessionID)
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+
+	session, exists := sh.sessions[sessionID]
+	if !exists {
+		return SessionData{}, ErrSessionNotFound
+	}
+
+	now := time.Now()
+	if s.timeouts.expired(*session, now) {
+		delete(sh.sessions, sessionID)
+		return SessionData{}, ErrSessionNotFound
+	}
+
+	// Update last access (คืนค่าเป็น copy เพื่อไม่ให้ใครแก้ข้อมูลนอก lock)
+	session.LastAccess = now
+	return *session, nil
+}
+
+func (s *MemorySessionStore) Delete(sessionID string) error {
+	sh := s.shard(sessionID)
+	sh.mu.Lock()
+	delete(sh.sessions, sessionID)
+	sh.mu.Unlock()
+	return nil
+}
+
+func (s *MemorySessionStore) DeleteExpired() (int, error) {
+	now := time.Now()
+	deleted := 0
+	for _, sh := range s.shards {
+		sh.mu.Lock()
+		for id, session := range sh.sessions {
+			if s.timeouts.expired(*session, now) {
+				delete(sh.sessions, id)
+				deleted++
+			}
+		}
+		sh.mu.Unlock()
+	}
+	return deleted, nil
+}
+
+// ===================== Postgres Store =====================
+// ใช้ร่วมกันได้หลาย instance (session ไม่หายตอน restart)
+type PostgresSessionStore struct {
+	db       *sql.DB
+	timeouts SessionTimeouts
+}
+
+// ตาราง sessions สร้างจาก migration1.sql
+func NewPostgresSessionStore(db *sql.DB, timeouts SessionTimeouts) *PostgresSessionStore {
+	return &PostgresSessionStore{db: db, timeouts: timeouts}
+}
+
+func (s *PostgresSessionStore) Create(data SessionData) (string, error) {
+	sessionID, err := generateRandomID()
+	if err != nil {
+		return "", err
+	}
+
+	// เวลาใช้ NOW() ของ DB ทั้งตอนเขียนและตอนเทียบ (ไม่ปน time.Now() ของ Go ที่ timezone/นาฬิกาอาจไม่ตรงกัน)
+	_, err = s.db.Exec(
+		`INSERT INTO sessions (id, user_id, username, roles, created_at, last_access)
+		 VALUES ($1, $2, $3, $4, NOW(), NOW())`,
+		sessionID, data.UserID, data.Username, pq.Array(data.Roles),
+	)
+	if err != nil {
+		return "", err
+	}
+	return sessionID, nil
+}
+
+func (s *PostgresSessionStore) Get(sessionID string) (SessionData, error) {
+	// เช็คอายุและต่ออายุใน UPDATE เดียว (ไม่มีช่องว่างระหว่างอ่านกับเขียน)
+	var session SessionData
+	err := s.db.QueryRow(`
+		UPDATE sessions
+		SET last_access = NOW()
+		WHERE id = $1
+		  AND created_at > NOW() - make_interval(secs => $2)
+		  AND last_access > NOW() - make_interval(secs => $3)
+		RETURNING user_id, username, roles, created_at, last_access
+	`, sessionID, s.timeouts.Absolute.Seconds(), s.timeouts.Idle.Seconds()).Scan(
+		&session.UserID, &session.Username, pq.Array(&session.Roles), &session.CreatedAt, &session.LastAccess,
+	)
+	if err == sql.ErrNoRows {
+		return SessionData{}, ErrSessionNotFound
+	}
+	if err != nil {
+		return SessionData{}, err
+	}
+	return session, nil
+}
+
+func (s *PostgresSessionStore) Delete(sessionID string) error {
+	_, err := s.db.Exec("DELETE FROM sessions WHERE id = $1", sessionID)
+	return err
+}
+
+func (s *PostgresSessionStore) DeleteExpired() (int, error) {
+	result, err := s.db.Exec(`
+		DELETE FROM sessions
+		WHERE created_at <= NOW() - make_interval(secs => $1)
+		   OR last_access <= NOW() - make_interval(secs => $2)
+	`, s.timeouts.Absolute.Seconds(), s.timeouts.Idle.Seconds())
+	if err != nil {
+		return 0, err
+	}
+	deleted, err := result.RowsAffected()
+	return int(deleted), err
+}
+
+// ===================== Store Setup =====================
+var store SessionStore
+var sessionTimeouts SessionTimeouts
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func initSessionStore() {
+	sessionTimeouts = SessionTimeouts{
+		Absolute: getEnvDuration("SESSION_ABSOLUTE_TIMEOUT", 8*time.Hour),
+		Idle:     getEnvDuration("SESSION_IDLE_TIMEOUT", 30*time.Minute),
+	}
+
+	if getEnv("SESSION_STORE", "memory") != "postgres" {
+		store = NewMemorySessionStore(sessionTimeouts)
+		log.Println("using in-memory session store")
+		return
+	}
+
+	password := os.Getenv("DB_PASSWORD") // ไม่มีค่า default: ห้ามฝังรหัสผ่านไว้ในโค้ด
+	if password == "" {
+		log.Fatal("DB_PASSWORD must be set")
+	}
+	conSt := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable",
+		getEnv("DB_HOST", "localhost"), getEnv("DB_PORT", "5432"), getEnv("DB_USER", "bookstore_user"),
+		password, getEnv("DB_NAME", "bookstore"))
+	db, err := sql.Open("postgres", conSt)
+	if err != nil {
+		log.Fatal("failed to open database")
+	}
+	if err := db.Ping(); err != nil {
+		log.Fatal("failed to connect to database", err)
+	}
+
+	store = NewPostgresSessionStore(db, sessionTimeouts)
+	log.Println("using postgres session store")
+}
+
+// GC: ลบ session ที่หมดอายุเป็นระยะ (Get ก็ไม่คืน session ที่หมดอายุอยู่แล้ว แต่ต้องเก็บกวาดพื้นที่)
+func runSessionGC(interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		deleted, err := store.DeleteExpired()
+		if err != nil {
+			log.Printf("Error deleting expired sessions: %v", err)
+		} else if deleted > 0 {
+			log.Printf("Deleted %d expired sessions", deleted)
+		}
+	}
 }
 
 type User struct {
@@ -33,10 +284,17 @@ type User struct {
 	Roles    []string
 }
 
-func generateRandomID() string {
+func generateRandomID() (string, error) {
 	b := make([]byte, 16)
-	rand.Read(b)
-	return hex.EncodeToString(b)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func setSessionCookie(c *gin.Context, sessionID string, maxAge time.Duration) {
+	c.SetCookie("session_id", sessionID, int(maxAge.Seconds()), "/", "", false, true)
+	// httpOnly=true >> JavaScript access ไม่ได้ (ป้องกัน XSS)
 }
 
 // Login
@@ -48,23 +306,30 @@ func login(c *gin.Context) {
         Roles:    []string{"admin"},
     }
 
-    // สร้าง session ID
-    sessionID := generateRandomID()
+    // Rotate session ID: ทิ้ง session เดิม (ถ้ามี) ป้องกัน session fixation
+    if oldSessionID, err := c.Cookie("session_id"); err == nil {
+        if err := store.Delete(oldSessionID); err != nil {
+            log.Printf("Error deleting old session: %v", err)
+        }
+    }
 
-    // เก็บ session data
-    store.mu.Lock()
-    store.sessions[sessionID] = &SessionData{
+    // สร้าง session ใหม่
+    now := time.Now()
+    session := SessionData{
         UserID:     user.ID,
         Username:   user.Username,
         Roles:      user.Roles,
-        CreatedAt:  time.Now(),
-        LastAccess: time.Now(),
+        CreatedAt:  now,
+        LastAccess: now,
+    }
+    sessionID, err := store.Create(session)
+    if err != nil {
+        c.JSON(500, gin.H{"error": "failed to create session"})
+        return
     }
-    store.mu.Unlock()
 
     // ส่ง cookie
-    c.SetCookie("session_id", sessionID, 3600, "/", "", false, true)
-    // httpOnly=true >> JavaScript access ไม่ได้ (ป้องกัน XSS)
+    setSessionCookie(c, sessionID, sessionTimeouts.remaining(session, now))
     c.JSON(200, gin.H{"message": "logged in"})
 }
 
@@ -78,21 +343,21 @@ func sessionMiddleware() gin.HandlerFunc {
             return
         }
 
-        // ดึง session data
-        store.mu.RLock()
-        session, exists := store.sessions[sessionID]
-        store.mu.RUnlock()
-
-        if !exists {
+        // ดึง session data (store อัปเดต last access ให้แล้ว)
+        session, err := store.Get(sessionID)
+        if err == ErrSessionNotFound {
+            c.SetCookie("session_id", "", -1, "/", "", false, true)
             c.JSON(401, gin.H{"error": "invalid session"})
             c.Abort()
             return
+        } else if err != nil {
+            c.JSON(500, gin.H{"error": "internal error"})
+            c.Abort()
+            return
         }
 
-        // Update last access
-        store.mu.Lock()
-        session.LastAccess = time.Now()
-        store.mu.Unlock()
+        // Sliding renewal: ต่ออายุ cookie ตาม idle timeout (ไม่เกิน absolute timeout)
+        setSessionCookie(c, sessionID, sessionTimeouts.remaining(session, time.Now()))
 
         // เก็บข้อมูล user ใน context
         c.Set("user_id", session.UserID)
@@ -108,9 +373,10 @@ func logout(c *gin.Context) {
     sessionID, _ := c.Cookie("session_id")
 
     // ลบ session
-    store.mu.Lock()
-    delete(store.sessions, sessionID)
-    store.mu.Unlock()
+    if err := store.Delete(sessionID); err != nil {
+        c.JSON(500, gin.H{"error": "failed to delete session"})
+        return
+    }
 
     // ลบ cookie
     c.SetCookie("session_id", "", -1, "/", "", false, true)
@@ -118,6 +384,9 @@ func logout(c *gin.Context) {
 }
 
 func main() {
+	initSessionStore()
+	go runSessionGC(getEnvDuration("SESSION_GC_INTERVAL", time.Minute))
+
 	r := gin.Default()
 
 	r.POST("/login", login)
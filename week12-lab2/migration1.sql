@@ -0,0 +1,12 @@
+-- 1. Sessions (ใช้เมื่อ SESSION_STORE=postgres)
+CREATE TABLE sessions (
+    id VARCHAR(64) PRIMARY KEY,
+    user_id INTEGER NOT NULL,
+    username VARCHAR(50) NOT NULL,
+    roles TEXT[] NOT NULL DEFAULT '{}',
+    created_at TIMESTAMPTZ NOT NULL DEFAULT NOW(),
+    last_access TIMESTAMPTZ NOT NULL DEFAULT NOW()
+);
+
+-- DeleteExpired ลบตาม last_access / created_at
+CREATE INDEX idx_sessions_last_access ON sessions(last_access);
@@ -1,18 +1,24 @@
 package main
 
 import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
 	"fmt"
+	"log"
+	"os"
 	"sync"
 	"time"
 
 	"github.com/gin-gonic/gin"
 	"github.com/golang-jwt/jwt/v5"
+	_ "github.com/lib/pq"
 )
 
 // JWT + Refresh Token + Token Blacklist
-// 1. Login >> สร้าง JWT
+// 1. Login >> สร้าง JWT (มี jti ประจำ token)
 // 2. เก็บ JWT ใน httpOnly cookie (ไม่ใช่ localStorage)
-// 3. Backend verify JWT แต่ check blacklist ด้วย
+// 3. Backend verify JWT แต่ check blacklist ด้วย (เก็บ jti ที่ถูก revoke ไว้ใน Postgres)
 
 // กำหนด Claims structure
 type CustomClaims struct {
@@ -29,6 +35,48 @@ type User struct {
 
 var secretKey = []byte("my-super-secret-key-change-in-production")
 
+var db *sql.DB
+
+func getEnv(key, defaultValue string) string {
+	if value := os.Getenv(key); value != "" {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func initDB() {
+	var err error
+	host := getEnv("DB_HOST", "localhost")
+	name := getEnv("DB_NAME", "bookstore")
+	user := getEnv("DB_USER", "bookstore_user")
+	password := os.Getenv("DB_PASSWORD") // ไม่มีค่า default: ห้ามฝังรหัสผ่านไว้ในโค้ด
+	if password == "" {
+		log.Fatal("DB_PASSWORD must be set")
+	}
+	port := getEnv("DB_PORT", "5432")
+	conSt := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, name)
+	db, err = sql.Open("postgres", conSt)
+	if err != nil {
+		log.Fatal("failed to open database")
+	}
+	db.SetMaxOpenConns(25)
+	db.SetMaxIdleConns(25)
+	db.SetConnMaxLifetime(5 * time.Minute)
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("failed to connect to database", err)
+	}
+	// ตาราง revoked_tokens สร้างจาก migration1.sql
+	log.Println("successfully connected to database")
+}
+
 // Mock user database
 var users = map[string]User{
 	"alice": {
@@ -43,11 +91,21 @@ var users = map[string]User{
 	},
 }
 
-// Token blacklist (in-memory)
+// Token blacklist cache (in-process) อยู่หน้า revoked_tokens ใน Postgres
+// revoked: jti ที่รู้แล้วว่าถูก revoke (เก็บจนกว่า token จะหมดอายุ)
+// checked: jti ที่เช็คแล้วว่ายังไม่ถูก revoke (เชื่อได้แค่ช่วง blacklistCacheTTL)
+//
+// ข้อแลกเปลี่ยน: token ที่ถูก logout บน replica อื่นยังใช้กับ replica นี้ได้อีกไม่เกิน
+// BLACKLIST_CACHE_TTL (default 5s) ตั้งเป็น 0 ถ้าต้องการให้ revoke มีผลทันทีทุก replica
+// (แลกกับ query DB ทุก request) ส่วน logout บน replica เดียวกันมีผลทันทีเสมอ
 var blacklist = struct {
 	sync.RWMutex
-	tokens map[string]bool
-}{tokens: make(map[string]bool)}
+	revoked map[string]time.Time
+	checked map[string]time.Time
+}{revoked: make(map[string]time.Time), checked: make(map[string]time.Time)}
+
+var blacklistCacheTTL = getEnvDuration("BLACKLIST_CACHE_TTL", 5*time.Second)
+var blacklistSweepInterval = getEnvDuration("BLACKLIST_SWEEP_INTERVAL", 10*time.Minute)
 
 // Refresh token storage (in-memory)
 var refreshTokenStore = struct {
@@ -55,14 +113,29 @@ var refreshTokenStore = struct {
 	tokens map[int]string // userID -> refreshToken
 }{tokens: make(map[int]string)}
 
+// jti แบบสุ่ม ใช้อ้างอิง token ตอน revoke (ไม่ต้องเก็บ token ทั้งก้อน)
+func generateJTI() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
 // ฟังก์ชันสร้าง JWT
 func generateToken(user User, duration time.Duration) (string, error) {
 	expirationTime := time.Now().Add(duration)
 
+	jti, err := generateJTI()
+	if err != nil {
+		return "", err
+	}
+
 	claims := &CustomClaims{
 		UserID:   user.ID,
 		Username: user.Username,
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "bookstore-api",
@@ -99,16 +172,81 @@ func verifyToken(tokenString string) (*CustomClaims, error) {
 }
 
 // Blacklist functions
-func isBlacklisted(token string) bool {
+func isBlacklisted(jti string) bool {
 	blacklist.RLock()
-	defer blacklist.RUnlock()
-	return blacklist.tokens[token]
+	_, revoked := blacklist.revoked[jti]
+	checkedAt, checked := blacklist.checked[jti]
+	blacklist.RUnlock()
+
+	if revoked {
+		return true
+	}
+	if checked && time.Since(checkedAt) < blacklistCacheTTL {
+		return false
+	}
+
+	var expiresAt time.Time
+	err := db.QueryRow("SELECT expires_at FROM revoked_tokens WHERE jti = $1", jti).Scan(&expiresAt)
+	if err != nil && err != sql.ErrNoRows {
+		// เช็คไม่ได้ถือว่า revoke ไว้ก่อน (fail closed)
+		log.Printf("Error checking token blacklist: %v", err)
+		return true
+	}
+
+	blacklist.Lock()
+	defer blacklist.Unlock()
+	if err == sql.ErrNoRows {
+		blacklist.checked[jti] = time.Now()
+		return false
+	}
+	blacklist.revoked[jti] = expiresAt
+	delete(blacklist.checked, jti)
+	return true
 }
 
-func addToBlacklist(token string) {
+func addToBlacklist(jti string, expiresAt time.Time) error {
+	_, err := db.Exec(
+		"INSERT INTO revoked_tokens (jti, expires_at) VALUES ($1, $2) ON CONFLICT (jti) DO NOTHING",
+		jti, expiresAt,
+	)
+	if err != nil {
+		return err
+	}
+
 	blacklist.Lock()
 	defer blacklist.Unlock()
-	blacklist.tokens[token] = true
+	blacklist.revoked[jti] = expiresAt
+	delete(blacklist.checked, jti)
+	return nil
+}
+
+// ลบ jti ของ token ที่หมดอายุแล้วออกจาก DB และ cache เป็นระยะ
+func sweepBlacklist() {
+	ticker := time.NewTicker(blacklistSweepInterval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		result, err := db.Exec("DELETE FROM revoked_tokens WHERE expires_at < NOW()")
+		if err != nil {
+			log.Printf("Error sweeping token blacklist: %v", err)
+		} else if deleted, _ := result.RowsAffected(); deleted > 0 {
+			log.Printf("Removed %d expired entries from token blacklist", deleted)
+		}
+
+		now := time.Now()
+		blacklist.Lock()
+		for jti, expiresAt := range blacklist.revoked {
+			if now.After(expiresAt) {
+				delete(blacklist.revoked, jti)
+			}
+		}
+		for jti, checkedAt := range blacklist.checked {
+			if now.Sub(checkedAt) >= blacklistCacheTTL {
+				delete(blacklist.checked, jti)
+			}
+		}
+		blacklist.Unlock()
+	}
 }
 
 // Refresh token functions
@@ -197,16 +335,16 @@ func authMiddleware() gin.HandlerFunc {
 			return
 		}
 
-		// Verify JWT
+		// Verify JWT (token ที่ไม่มี jti revoke ไม่ได้ จึงไม่รับ)
 		claims, err := verifyToken(tokenString)
-		if err != nil {
+		if err != nil || claims.ID == "" {
 			c.JSON(401, gin.H{"error": "invalid token"})
 			c.Abort()
 			return
 		}
 
 		// Check blacklist
-		if isBlacklisted(tokenString) {
+		if isBlacklisted(claims.ID) {
 			c.JSON(401, gin.H{"error": "token revoked"})
 			c.Abort()
 			return
@@ -263,9 +401,12 @@ func refresh(c *gin.Context) {
 func logout(c *gin.Context) {
 	// ดึง access token
 	accessToken, _ := c.Cookie("access_token")
-	if accessToken != "" {
-		// เพิ่มเข้า blacklist
-		addToBlacklist(accessToken)
+	if claims, err := verifyToken(accessToken); err == nil && claims.ID != "" {
+		// เพิ่ม jti เข้า blacklist จนกว่า token จะหมดอายุ
+		if err := addToBlacklist(claims.ID, claims.ExpiresAt.Time); err != nil {
+			c.JSON(500, gin.H{"error": "failed to revoke token"})
+			return
+		}
 	}
 
 	// ดึง user_id เพื่อลบ refresh token
@@ -282,6 +423,10 @@ func logout(c *gin.Context) {
 }
 
 func main() {
+	initDB()
+	defer db.Close()
+	go sweepBlacklist()
+
 	r := gin.Default()
 
 	// Public routes
@@ -0,0 +1,9 @@
+-- 1. Revoked Access Tokens (blacklist ที่แชร์กันได้ทุก replica)
+-- เก็บแค่ jti กับเวลาหมดอายุของ token (หมดอายุแล้วลบทิ้งได้ เพราะ token ใช้ไม่ได้อยู่แล้ว)
+CREATE TABLE revoked_tokens (
+    jti VARCHAR(64) PRIMARY KEY,
+    expires_at TIMESTAMPTZ NOT NULL,
+    revoked_at TIMESTAMPTZ DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_revoked_tokens_expires ON revoked_tokens(expires_at);
@@ -3,8 +3,27 @@ package main
 import (
 	_ "week13-assignment/docs"
 	"fmt"
+	"errors"
+	"sync"
 	"os"
 	"database/sql"
+	"math"
+	"strconv"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/subtle"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"strings"
+	"regexp"
+	"io"
+	"crypto/rand"
+	"encoding/hex"
 	_ "github.com/lib/pq"
 	"log"
 	"github.com/gin-gonic/gin"
@@ -67,6 +86,14 @@ type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
+type RefreshTokenRecord struct {
+	UserID     int
+	FamilyID   string
+	ExpiresAt  time.Time
+	RevokedAt  sql.NullTime
+	ReplacedBy sql.NullString
+}
+
 // ===================== JWT Claims =====================
 type CustomClaims struct {
 	UserID   int      `json:"user_id"`
@@ -85,9 +112,292 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
+// ค่าที่คั่นด้วย comma (ตัดช่องว่างและค่าว่างทิ้ง)
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
+	}
+	return values
+}
+
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+func getEnvBool(key string, defaultValue bool) bool {
+	if value, err := strconv.ParseBool(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
+}
+
+// ===================== Cookie Settings =====================
+// ตั้งค่าผ่าน env แทนการ hard-code (production ควรเป็น Secure + __Host-)
+var cookieConfig struct {
+	Secure     bool
+	SameSite   http.SameSite
+	HostPrefix bool
+}
+
+func initCookieConfig() {
+	cookieConfig.Secure = getEnvBool("COOKIE_SECURE", false)
+	cookieConfig.HostPrefix = getEnvBool("COOKIE_HOST_PREFIX", false)
+
+	switch strings.ToLower(getEnv("COOKIE_SAMESITE", "lax")) {
+	case "strict":
+		cookieConfig.SameSite = http.SameSiteStrictMode
+	case "none":
+		cookieConfig.SameSite = http.SameSiteNoneMode
+	default:
+		cookieConfig.SameSite = http.SameSiteLaxMode
+	}
+
+	// __Host- และ SameSite=None ใช้ได้เฉพาะ cookie ที่เป็น Secure (browser จะไม่รับ)
+	if (cookieConfig.HostPrefix || cookieConfig.SameSite == http.SameSiteNoneMode) && !cookieConfig.Secure {
+		log.Println("COOKIE_HOST_PREFIX/COOKIE_SAMESITE=none require Secure cookies, forcing COOKIE_SECURE=true")
+		cookieConfig.Secure = true
+	}
+}
+
+func cookieName(name string) string {
+	if cookieConfig.HostPrefix {
+		return "__Host-" + name
+	}
+	return name
+}
+
+// Path ต้องเป็น "/" และไม่มี Domain เพื่อให้ตรงเงื่อนไขของ __Host-
+func setCookie(c *gin.Context, name, value string, maxAge int, httpOnly bool) {
+	http.SetCookie(c.Writer, &http.Cookie{
+		Name:     cookieName(name),
+		Value:    value,
+		MaxAge:   maxAge,
+		Path:     "/",
+		Secure:   cookieConfig.Secure,
+		HttpOnly: httpOnly,
+		SameSite: cookieConfig.SameSite,
+	})
+}
+
+func readCookie(c *gin.Context, name string) (string, error) {
+	return c.Cookie(cookieName(name))
+}
+
+// ===================== CSRF Protection =====================
+// double-submit cookie: csrf_token อ่านได้จาก JavaScript แล้วส่งกลับมาใน header X-CSRF-Token
+// เว็บอื่นส่ง cookie มาได้แต่อ่านค่าไม่ได้ จึงใส่ header ให้ตรงกันไม่ได้
+const csrfHeader = "X-CSRF-Token"
+
+// ออก csrf token ใหม่พร้อมกับ auth cookies (login/refresh)
+func setAuthCookies(c *gin.Context, accessToken, refreshToken string) (string, error) {
+	csrfToken, err := generateRandomID()
+	if err != nil {
+		return "", err
+	}
+	setCookie(c, "access_token", accessToken, 900, true)     // 15 minutes
+	setCookie(c, "refresh_token", refreshToken, 604800, true) // 7 days
+	setCookie(c, "csrf_token", csrfToken, 604800, false)      // อายุเท่า refresh token
+	return csrfToken, nil
+}
+
+func clearAuthCookies(c *gin.Context) {
+	setCookie(c, "access_token", "", -1, true)
+	setCookie(c, "refresh_token", "", -1, true)
+	setCookie(c, "csrf_token", "", -1, false)
+}
+
+func csrfMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+			c.Next()
+			return
+		}
+
+		cookieToken, err := readCookie(c, "csrf_token")
+		headerToken := c.GetHeader(csrfHeader)
+		if err != nil || cookieToken == "" || headerToken == "" ||
+			subtle.ConstantTimeCompare([]byte(cookieToken), []byte(headerToken)) != 1 {
+			c.JSON(http.StatusForbidden, gin.H{"error": "invalid or missing CSRF token"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ===================== Redaction =====================
+// ล้างข้อมูลลับก่อนบันทึกลง audit_logs, log และ error response
+// field: ชื่อ key ที่ห้ามเก็บค่า (ตรงตัว หรือเป็นส่วนหนึ่งที่คั่นด้วย _ เช่น refresh_token, password_hash)
+// pattern: ค่าหน้าตาเป็นความลับไม่ว่าจะอยู่ใน field ไหน (JWT, email, Bearer ...)
+// เพิ่มได้ผ่าน REDACT_FIELDS (คั่นด้วย ,) และ REDACT_PATTERNS (regex คั่นด้วยช่องว่าง)
+const redactedValue = "[REDACTED]"
+
+type redactPattern struct {
+	re          *regexp.Regexp
+	replacement string
+}
+
+var redaction struct {
+	fields   []string
+	patterns []redactPattern
+}
+
+func initRedaction() {
+	redaction.fields = []string{"password", "token", "secret", "authorization", "cookie", "api_key", "csrf"}
+	for _, field := range strings.Split(getEnv("REDACT_FIELDS", ""), ",") {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			redaction.fields = append(redaction.fields, field)
+		}
+	}
+
+	// key=value (query string, cookie) และ "key": "value" (JSON) ของ field ที่ห้ามเก็บ
+	fieldNames := make([]string, len(redaction.fields))
+	for i, field := range redaction.fields {
+		fieldNames[i] = regexp.QuoteMeta(field)
+	}
+	fieldKey := `((?:[a-z0-9]+_)*(?:` + strings.Join(fieldNames, "|") + `)(?:_[a-z0-9]+)*)`
+
+	redaction.patterns = []redactPattern{
+		{regexp.MustCompile(`(?i)"` + fieldKey + `"\s*:\s*"[^"]*"`), `"$1":"` + redactedValue + `"`},
+		{regexp.MustCompile(`(?i)\b` + fieldKey + `=[^&;\s"]+`), "$1=" + redactedValue},
+		{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`), "Bearer " + redactedValue},
+		{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), "[REDACTED_JWT]"},
+		{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED_EMAIL]"},
+	}
+	for _, pattern := range strings.Fields(getEnv("REDACT_PATTERNS", "")) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("invalid REDACT_PATTERNS entry %q: %v", pattern, err)
+		}
+		redaction.patterns = append(redaction.patterns, redactPattern{re, redactedValue})
+	}
+}
+
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range redaction.fields {
+		if key == field || strings.HasPrefix(key, field+"_") || strings.HasSuffix(key, "_"+field) ||
+			strings.Contains(key, "_"+field+"_") {
+			return true
+		}
+	}
+	return false
+}
+
+func redactString(s string) string {
+	for _, p := range redaction.patterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
+	}
+	return s
+}
+
+// ไล่ redact ทั้ง map/slice ซ้อนกัน (details ของ audit log)
+func redactValue(key string, value interface{}) interface{} {
+	if isSensitiveField(key) {
+		return redactedValue
+	}
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case map[string]interface{}:
+		return redactDetails(v)
+	case gin.H:
+		return redactDetails(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValue("", item)
+		}
+		return out
+	case []string:
+		out := make([]string, len(v))
+		for i, item := range v {
+			out[i] = redactString(item)
+		}
+		return out
+	}
+	return value
+}
+
+func redactDetails(details map[string]interface{}) map[string]interface{} {
+	if details == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(details))
+	for key, value := range details {
+		out[key] = redactValue(key, value)
+	}
+	return out
+}
+
+// ครอบ writer ของ log/gin ให้ทุกบรรทัดผ่าน redactString ก่อนพิมพ์
+type redactingWriter struct {
+	w io.Writer
+}
+
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redactString(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+// server error ทุกอันผ่านตรงนี้ (status >= 500) ไม่ต้องพึ่งให้ทุก handler จำเรียก redactString เอง
+// เช่น err.Error() จาก DB ที่อาจมี connection string หรือค่าใน query ติดมา
+// 4xx ไม่แตะ เพราะ body อาจมีค่าที่ client ต้องใช้ต่อ (เช่น token ที่ตั้งใจส่งกลับ)
+type redactingResponseWriter struct {
+	gin.ResponseWriter
+}
+
+func (w redactingResponseWriter) Write(p []byte) (int, error) {
+	if w.Status() < http.StatusInternalServerError {
+		return w.ResponseWriter.Write(p)
+	}
+	if _, err := w.ResponseWriter.Write([]byte(redactString(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
+}
+
+func (w redactingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
+}
+
+func redactErrorResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = redactingResponseWriter{c.Writer}
+		c.Next()
+	}
+}
+
 // ===================== Password Hashing =====================
+// cost ปรับขึ้นได้ทีหลัง hash เก่าจะถูก rehash ตอน login (ดู needsRehash)
+var bcryptCost = getEnvInt("BCRYPT_COST", 12)
+
+// bcrypt ใช้ DefaultCost แทนเงียบๆ ถ้า cost ต่ำกว่า MinCost และ error ทุกครั้งถ้าเกิน MaxCost
+// ตั้งค่าผิดต้องพังตั้งแต่ start ไม่ใช่ไปพังตอนสมัคร/เปลี่ยนรหัส
+func initBcryptCost() {
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		log.Fatalf("BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, bcryptCost)
+	}
+}
+
 func hashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
 	if err != nil {
 		return "", err
 	}
@@ -98,6 +408,251 @@ func verifyPassword(hashedPassword, password string) error {
 	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
 }
 
+// hash ที่ไม่ใช่ bcrypt หรือ cost ต่ำกว่าค่าปัจจุบัน ควรสร้างใหม่
+func needsRehash(hashedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	return err != nil || cost < bcryptCost
+}
+
+// login สำเร็จ = รู้รหัสจริง จึงเป็นจังหวะเดียวที่ upgrade hash เก่าได้
+// เงื่อนไข password_hash เดิม กันไม่ให้ทับรหัสที่เพิ่งถูกเปลี่ยนไปพร้อมกัน
+func rehashPassword(c *gin.Context, user *User, password string) {
+	if !needsRehash(user.PasswordHash) {
+		return
+	}
+	newHash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password: %v", err)
+		return
+	}
+	if _, err := db.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3",
+		newHash, user.ID, user.PasswordHash,
+	); err != nil {
+		log.Printf("Error rehashing password: %v", err)
+		return
+	}
+	logAudit(user.ID, "password_rehash", "users", user.ID, map[string]interface{}{"cost": bcryptCost}, c)
+	user.PasswordHash = newHash
+}
+
+// ===================== JWT Signing Keys =====================
+// ตั้ง JWT_SIGNING_KEY_FILE (PEM: RSA หรือ Ed25519) เพื่อเซ็นด้วย RS256/EdDSA และใส่ kid ใน header
+// JWT_VERIFICATION_KEY_FILES (public key คั่นด้วย comma) คือ key เก่าที่ยัง verify ได้ระหว่าง rotate
+// service อื่นดึง public key จาก /.well-known/jwks.json ไป verify ได้ โดยไม่ต้องรู้ secret
+// ถ้าไม่ตั้งทั้งสองค่าจะใช้ HS256 + jwtSecret แบบเดิม
+type jwtKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	publicKey crypto.PublicKey
+}
+
+type jwtKeyRing struct {
+	signingKid    string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.Signer
+	verifyKeys    map[string]*jwtKey
+}
+
+var jwtKeys = &jwtKeyRing{verifyKeys: map[string]*jwtKey{}}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// kid = SHA-256 ของ public key ทำให้ทุก service คำนวณได้ค่าเดียวกันจาก key เดียวกัน
+func jwtKeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+func (r *jwtKeyRing) addVerifyKey(pub crypto.PublicKey) (*jwtKey, error) {
+	var method jwt.SigningMethod
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	kid, err := jwtKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	key := &jwtKey{kid: kid, method: method, publicKey: pub}
+	r.verifyKeys[kid] = key
+	return key, nil
+}
+
+func initJWTKeys() {
+	if path := getEnv("JWT_SIGNING_KEY_FILE", ""); path != "" {
+		signer, err := loadPrivateKey(path)
+		if err != nil {
+			log.Fatal("failed to load JWT signing key: ", err)
+		}
+		key, err := jwtKeys.addVerifyKey(signer.Public())
+		if err != nil {
+			log.Fatal("failed to load JWT signing key: ", err)
+		}
+		jwtKeys.signingKid = key.kid
+		jwtKeys.signingMethod = key.method
+		jwtKeys.signingKey = signer
+	}
+
+	for _, path := range strings.Split(getEnv("JWT_VERIFICATION_KEY_FILES", ""), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		pub, err := loadPublicKey(path)
+		if err != nil {
+			log.Fatal("failed to load JWT verification key: ", err)
+		}
+		if _, err := jwtKeys.addVerifyKey(pub); err != nil {
+			log.Fatal("failed to load JWT verification key: ", err)
+		}
+	}
+
+	if len(jwtKeys.verifyKeys) == 0 {
+		log.Println("JWT keys not configured, using HS256 shared secret")
+		return
+	}
+	// มีแต่ key สำหรับ verify: server จะออก token ไม่ได้เลย ให้พังตั้งแต่ตอน start ดีกว่าไปพังตอน login
+	if jwtKeys.signingKey == nil {
+		log.Fatal("JWT_VERIFICATION_KEY_FILES is set but JWT_SIGNING_KEY_FILE is not")
+	}
+	log.Printf("JWT keys loaded: signing kid=%q, %d verification keys", jwtKeys.signingKid, len(jwtKeys.verifyKeys))
+}
+
+func signToken(claims jwt.Claims) (string, error) {
+	if len(jwtKeys.verifyKeys) == 0 {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(jwtSecret)
+	}
+	if jwtKeys.signingKey == nil {
+		return "", fmt.Errorf("no JWT signing key configured")
+	}
+
+	token := jwt.NewWithClaims(jwtKeys.signingMethod, claims)
+	token.Header["kid"] = jwtKeys.signingKid
+	return token.SignedString(jwtKeys.signingKey)
+}
+
+// เลือก key จาก kid และบังคับว่า alg ต้องตรงกับชนิดของ key (กัน alg confusion)
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if len(jwtKeys.verifyKeys) == 0 {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := jwtKeys.verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.publicKey, nil
+}
+
+func jwksHandler(c *gin.Context) {
+	keys := []JWK{}
+	for _, key := range jwtKeys.verifyKeys {
+		jwk := JWK{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		keys = append(keys, jwk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
 // ===================== JWT Functions =====================
 func generateAccessToken(userID int, username string, roles []string) (string, error) {
 	expirationTime := time.Now().Add(15 * time.Minute)
@@ -111,33 +666,32 @@ func generateAccessToken(userID int, username string, roles []string) (string, e
 			Issuer:    "bookstore-api",
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signToken(claims)
 }
 
 func generateRefreshToken(userID int, username string) (string, error) {
 	expirationTime := time.Now().Add(7 * 24 * time.Hour)
+	// jti ทำให้ token ที่ rotate ภายในวินาทีเดียวกันไม่ซ้ำกัน
+	jti, err := generateRandomID()
+	if err != nil {
+		return "", err
+	}
 	claims := &CustomClaims{
 		UserID:   userID,
 		Username: username,
 		Roles:    []string{},
 		RegisteredClaims: jwt.RegisteredClaims{
+			ID:        jti,
 			ExpiresAt: jwt.NewNumericDate(expirationTime),
 			IssuedAt:  jwt.NewNumericDate(time.Now()),
 			Issuer:    "bookstore-api",
 		},
 	}
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return signToken(claims)
 }
 
 func verifyToken(tokenString string) (*CustomClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, verificationKey)
 	if err != nil {
 		return nil, err
 	}
@@ -188,12 +742,20 @@ func checkUserPermission(userID int, permission string) bool {
 	return count > 0
 }
 
-func storeRefreshToken(userID int, token string, expiresAt time.Time) error {
+func generateRandomID() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func storeRefreshToken(userID int, token, familyID string, expiresAt time.Time) error {
 	query := `
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)
+		INSERT INTO refresh_tokens (user_id, token, family_id, expires_at)
+		VALUES ($1, $2, $3, $4)
 	`
-	_, err := db.Exec(query, userID, token, expiresAt)
+	_, err := db.Exec(query, userID, token, familyID, expiresAt)
 	return err
 }
 
@@ -207,42 +769,403 @@ func revokeRefreshToken(token string) error {
 	return err
 }
 
-func isRefreshTokenValid(token string) (int, bool) {
+func getRefreshTokenRecord(token string) (*RefreshTokenRecord, error) {
 	query := `
-		SELECT user_id
+		SELECT user_id, family_id, expires_at, revoked_at, replaced_by
 		FROM refresh_tokens
 		WHERE token = $1
-		AND expires_at > NOW()
-		AND revoked_at IS NULL
 	`
-	var userID int
-	err := db.QueryRow(query, token).Scan(&userID)
+	var rec RefreshTokenRecord
+	err := db.QueryRow(query, token).Scan(&rec.UserID, &rec.FamilyID, &rec.ExpiresAt, &rec.RevokedAt, &rec.ReplacedBy)
 	if err != nil {
-		return 0, false
+		return nil, err
 	}
-	return userID, true
+	return &rec, nil
 }
 
-func logAudit(userID int, action, resource string, resourceID interface{}, details map[string]interface{}, c *gin.Context) {
-	detailsJSON, _ := json.Marshal(details)
+func revokeTokenFamily(familyID string) (int64, error) {
 	query := `
-		INSERT INTO audit_logs
-		(user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE family_id = $1 AND revoked_at IS NULL
 	`
-	var resourceIDStr string
+	result, err := db.Exec(query, familyID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func logAudit(userID int, action, resource string, resourceID interface{}, details map[string]interface{}, c *gin.Context) {
+	detailsJSON, _ := json.Marshal(redactDetails(details))
+	record := &auditRecord{
+		Action:    action,
+		Resource:  resource,
+		Details:   canonicalJSON(detailsJSON),
+		IPAddress: c.ClientIP(),
+		UserAgent: redactString(c.GetHeader("User-Agent")),
+		CreatedAt: time.Now(),
+	}
+
+	// user_id = 0 (เช่น login ด้วย username ที่ไม่มีอยู่) บันทึกเป็น NULL
+	if userID > 0 {
+		record.UserID = &userID
+	}
+
 	if resourceID != nil {
-		resourceIDStr = fmt.Sprintf("%v", resourceID)
-	}
-	db.Exec(query,
-		userID,
-		action,
-		resource,
-		resourceIDStr,
-		detailsJSON,
-		c.ClientIP(),
-		c.GetHeader("User-Agent"),
+		record.ResourceID = fmt.Sprintf("%v", resourceID)
+	}
+	if err := appendAuditRecord(record); err != nil {
+		log.Printf("Error writing audit log: %v", err)
+	}
+}
+
+// ===================== Audit Hash Chain =====================
+// audit_logs ใช้ร่วมกับ week13-lab6 ซึ่งเก็บ hash chain (prev_hash, hash) และตรวจด้วย verify-audit
+// แถวที่ service นี้เขียนจึงต้องต่อ chain เดียวกัน: lock id, ลำดับ field และรูปแบบเวลาต้องตรงกับ lab6 ทุกตัว
+const auditChainLockID = 7311 // pg_advisory_xact_lock เดียวกับ lab6
+
+type auditRecord struct {
+	ID         int64
+	PrevHash   string
+	Hash       string
+	UserID     *int
+	Action     string
+	Resource   string
+	ResourceID string
+	Details    json.RawMessage
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+}
+
+// jsonb เรียง key และจัด whitespace ใหม่ จึงต้อง decode/encode ด้วย Go ก่อนคำนวณ hash
+func canonicalJSON(raw []byte) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return raw
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return raw
+	}
+	return canonical
+}
+
+func (r *auditRecord) computeHash() string {
+	canonical, _ := json.Marshal(struct {
+		ID         int64           `json:"id"`
+		PrevHash   string          `json:"prev_hash"`
+		UserID     *int            `json:"user_id"`
+		Action     string          `json:"action"`
+		Resource   string          `json:"resource"`
+		ResourceID string          `json:"resource_id"`
+		Details    json.RawMessage `json:"details"`
+		IPAddress  string          `json:"ip_address"`
+		UserAgent  string          `json:"user_agent"`
+		CreatedAt  string          `json:"created_at"`
+	}{
+		r.ID, r.PrevHash, r.UserID, r.Action, r.Resource, r.ResourceID,
+		canonicalJSON(r.Details), r.IPAddress, r.UserAgent,
+		r.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// ต่อท้าย chain ทีละแถวใน transaction (ถือ advisory lock ระหว่างอ่าน hash ล่าสุดจนถึง insert)
+func appendAuditRecord(record *auditRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", auditChainLockID); err != nil {
+		return err
+	}
+
+	err = tx.QueryRow("SELECT hash FROM audit_logs WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1").Scan(&record.PrevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// id เป็นส่วนหนึ่งของ hash จึงต้องจองก่อน insert
+	if err := tx.QueryRow("SELECT nextval(pg_get_serial_sequence('audit_logs', 'id'))").Scan(&record.ID); err != nil {
+		return err
+	}
+
+	record.CreatedAt = record.CreatedAt.UTC().Truncate(time.Microsecond)
+	record.Hash = record.computeHash()
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_logs
+		(id, user_id, action, resource, resource_id, details, ip_address, user_agent, created_at, prev_hash, hash)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11)
+	`, record.ID, record.UserID, record.Action, record.Resource, record.ResourceID, []byte(record.Details),
+		record.IPAddress, record.UserAgent, record.CreatedAt, record.PrevHash, record.Hash)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ===================== Brute-force Protection =====================
+// นับ login ที่ผิดแยกตาม username และ IP ใน login_attempts (แชร์กันได้หลาย replica)
+// ผิดแต่ละครั้งต้องรอนานขึ้นเป็นเท่าตัว (exponential backoff) และครบ threshold จะถูกล็อคชั่วคราว
+var (
+	loginUserLockoutThreshold = getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	loginIPLockoutThreshold   = getEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 20)
+	loginLockoutDuration      = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginAttemptWindow        = getEnvDuration("LOGIN_ATTEMPT_WINDOW", 15*time.Minute)
+	loginBackoffBase          = getEnvDuration("LOGIN_BACKOFF_BASE", time.Second)
+	loginBackoffMax           = getEnvDuration("LOGIN_BACKOFF_MAX", 30*time.Second)
+)
+
+type LoginAttempt struct {
+	KeyType      string     `json:"key_type"`
+	KeyValue     string     `json:"key_value"`
+	FailedCount  int        `json:"failed_count"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+type UnlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+func loginBackoff(failedCount int) time.Duration {
+	if failedCount <= 0 {
+		return 0
+	}
+	if failedCount > 16 {
+		return loginBackoffMax
+	}
+	delay := loginBackoffBase << (failedCount - 1)
+	if delay > loginBackoffMax {
+		return loginBackoffMax
+	}
+	return delay
+}
+
+// คืนเวลาที่ต้องรอก่อน login ได้อีกครั้ง (0 = login ได้เลย)
+func loginRetryAfter(keyType, keyValue string) time.Duration {
+	var failedCount int
+	var sinceLastFailure, lockedFor float64
+	err := db.QueryRow(
+		`SELECT failed_count,
+			EXTRACT(EPOCH FROM NOW() - last_failed_at)::float8,
+			COALESCE(EXTRACT(EPOCH FROM locked_until - NOW()), 0)::float8
+		 FROM login_attempts
+		 WHERE key_type = $1 AND key_value = $2`,
+		keyType, keyValue,
+	).Scan(&failedCount, &sinceLastFailure, &lockedFor)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error checking login attempts: %v", err)
+		}
+		return 0
+	}
+
+	if lockedFor > 0 {
+		return time.Duration(lockedFor * float64(time.Second))
+	}
+	elapsed := time.Duration(sinceLastFailure * float64(time.Second))
+	if elapsed > loginAttemptWindow {
+		return 0
+	}
+	if wait := loginBackoff(failedCount) - elapsed; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// นับ login ผิดเพิ่ม 1 ครั้ง (เริ่มนับใหม่ถ้าครั้งก่อนเกิน window) และล็อคถ้าครบ threshold
+func registerLoginFailure(keyType, keyValue string, threshold int) (int, bool) {
+	var failedCount int
+	err := db.QueryRow(
+		`INSERT INTO login_attempts (key_type, key_value, failed_count, first_failed_at, last_failed_at)
+		 VALUES ($1, $2, 1, NOW(), NOW())
+		 ON CONFLICT (key_type, key_value) DO UPDATE SET
+			failed_count = CASE WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $3)
+				THEN 1 ELSE login_attempts.failed_count + 1 END,
+			first_failed_at = CASE WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $3)
+				THEN NOW() ELSE login_attempts.first_failed_at END,
+			last_failed_at = NOW()
+		 RETURNING failed_count`,
+		keyType, keyValue, loginAttemptWindow.Seconds(),
+	).Scan(&failedCount)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return 0, false
+	}
+
+	if failedCount < threshold {
+		return failedCount, false
+	}
+	_, err = db.Exec(
+		`UPDATE login_attempts SET locked_until = NOW() + make_interval(secs => $3)
+		 WHERE key_type = $1 AND key_value = $2`,
+		keyType, keyValue, loginLockoutDuration.Seconds(),
+	)
+	if err != nil {
+		log.Printf("Error locking login: %v", err)
+	}
+	return failedCount, true
+}
+
+// ผลการจองครั้งที่ของ request นี้ (เก็บใน context ให้ recordFailedLogin/clearLoginFailures ใช้)
+type loginAttemptReservation struct {
+	userCount int
+	ipCount   int
+}
+
+// เช็ค lockout/backoff จากครั้งก่อน แล้ว "จอง" attempt นี้โดยนับเพิ่มทันที (INSERT ... RETURNING failed_count)
+// ก่อนถึง bcrypt: request ที่ยิงมาพร้อมกันจะได้ลำดับคนละค่า ตัวที่เกิน threshold ถูกปฏิเสธทันที
+// ถ้า login สำเร็จจะคืน attempt ที่จองไว้ใน clearLoginFailures
+func checkLoginThrottle(c *gin.Context, username string) bool {
+	ip := c.ClientIP()
+	wait := loginRetryAfter("username", username)
+	if ipWait := loginRetryAfter("ip", ip); ipWait > wait {
+		wait = ipWait
+	}
+	if wait <= 0 {
+		userCount, _ := registerLoginFailure("username", username, loginUserLockoutThreshold)
+		ipCount, _ := registerLoginFailure("ip", ip, loginIPLockoutThreshold)
+		c.Set("login_attempt", loginAttemptReservation{userCount: userCount, ipCount: ipCount})
+		if userCount <= loginUserLockoutThreshold && ipCount <= loginIPLockoutThreshold {
+			return true
+		}
+		wait = loginLockoutDuration
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "too many failed login attempts, please try again later",
+		"retry_after": seconds,
+	})
+	return false
+}
+
+// attempt ถูกนับไปแล้วใน checkLoginThrottle ที่นี่แค่เขียน audit log (userID = 0 ถ้าไม่มี user นี้)
+func recordFailedLogin(c *gin.Context, userID int, username, reason string) {
+	value, _ := c.Get("login_attempt")
+	attempt, _ := value.(loginAttemptReservation)
+
+	logAudit(userID, "login_failed", "auth", nil, gin.H{
+		"username":     username,
+		"reason":       reason,
+		"failed_count": attempt.userCount,
+	}, c)
+
+	// attempt ที่ทำให้ครบ threshold คือตัวที่ล็อค
+	if attempt.userCount == loginUserLockoutThreshold {
+		logAudit(userID, "login_locked", "auth", nil, gin.H{
+			"key_type":        "username",
+			"key_value":       username,
+			"locked_for_secs": int(loginLockoutDuration.Seconds()),
+		}, c)
+	}
+	if attempt.ipCount == loginIPLockoutThreshold {
+		logAudit(userID, "login_locked", "auth", nil, gin.H{
+			"key_type":        "ip",
+			"key_value":       c.ClientIP(),
+			"locked_for_secs": int(loginLockoutDuration.Seconds()),
+		}, c)
+	}
+}
+
+// login สำเร็จล้างตัวนับของ username ส่วนของ IP แค่คืน attempt ที่จองไว้ 1 ครั้ง
+// (ไม่ล้างทั้งหมด ไม่อย่างนั้นคนที่มี account เดียวจะใช้ล้างตัวนับ IP ตัวเองได้)
+func clearLoginFailures(c *gin.Context, username string) {
+	db.Exec("DELETE FROM login_attempts WHERE key_type = 'username' AND key_value = $1", username)
+
+	if _, reserved := c.Get("login_attempt"); reserved {
+		db.Exec(
+			`UPDATE login_attempts
+			 SET failed_count = GREATEST(failed_count - 1, 0),
+				locked_until = CASE WHEN failed_count - 1 < $2 THEN NULL ELSE locked_until END
+			 WHERE key_type = 'ip' AND key_value = $1`,
+			c.ClientIP(), loginIPLockoutThreshold,
+		)
+	}
+}
+
+// proxy ที่เชื่อ X-Forwarded-For ได้ (comma-separated IP/CIDR) ไม่ตั้ง = ใช้ IP ของ connection ตรงๆ
+func trustedProxies() []string {
+	return getEnvList("TRUSTED_PROXIES", "")
+}
+
+// frontend อยู่คนละ origin: ต้องส่ง cookie (AllowCredentials) และ header X-CSRF-Token ได้
+// credentials ใช้กับ origin "*" ไม่ได้ จึงต้องระบุ origin ที่อนุญาตใน CORS_ALLOWED_ORIGINS
+func corsConfig() cors.Config {
+	config := cors.DefaultConfig()
+	config.AllowOrigins = getEnvList("CORS_ALLOWED_ORIGINS", "http://localhost:3000")
+	config.AllowCredentials = true
+	config.AllowHeaders = append(config.AllowHeaders, csrfHeader)
+	config.ExposeHeaders = []string{"Retry-After"}
+	return config
+}
+
+// ===================== Lockout Admin Endpoints =====================
+func listLockouts(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT key_type, key_value, failed_count, last_failed_at, locked_until
+		FROM login_attempts
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&a.KeyType, &a.KeyValue, &a.FailedCount, &a.LastFailedAt, &lockedUntil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if lockedUntil.Valid {
+			a.LockedUntil = &lockedUntil.Time
+		}
+		attempts = append(attempts, a)
+	}
+
+	c.JSON(http.StatusOK, attempts)
+}
+
+func unlockLogin(c *gin.Context) {
+	var req UnlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "" && req.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or ip required"})
+		return
+	}
+
+	result, err := db.Exec(
+		`DELETE FROM login_attempts
+		 WHERE (key_type = 'username' AND key_value = $1)
+		    OR (key_type = 'ip' AND key_value = $2)`,
+		req.Username, req.IP,
 	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cleared, _ := result.RowsAffected()
+
+	logAudit(c.GetInt("user_id"), "login_unlock", "auth", nil, gin.H{
+		"username": req.Username,
+		"ip":       req.IP,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "login unlocked", "cleared": cleared})
 }
 
 func initDB() {
@@ -275,10 +1198,16 @@ func login(c *gin.Context) {
 		return
 	}
 
+	// เช็ค lockout ก่อน query/bcrypt เพื่อไม่ให้ถูกใช้เผา CPU
+	if !checkLoginThrottle(c, req.Username) {
+		return
+	}
+
 	var user User
 	query := `SELECT id, username, email, password_hash, is_active FROM users WHERE username = $1`
 	err := db.QueryRow(query, req.Username).Scan(&user.ID, &user.Username, &user.Email, &user.PasswordHash, &user.IsActive)
 	if err == sql.ErrNoRows {
+		recordFailedLogin(c, 0, req.Username, "unknown_user")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	} else if err != nil {
@@ -292,73 +1221,169 @@ func login(c *gin.Context) {
 	}
 
 	if err := verifyPassword(user.PasswordHash, req.Password); err != nil {
+		recordFailedLogin(c, user.ID, req.Username, "invalid_password")
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
 		return
 	}
+	clearLoginFailures(c, req.Username)
+	rehashPassword(c, &user, req.Password)
 
 	roles, _ := getUserRoles(user.ID)
-	accessToken, _ := generateAccessToken(user.ID, user.Username, roles)
-	refreshToken, _ := generateRefreshToken(user.ID, user.Username)
+	accessToken, err := generateAccessToken(user.ID, user.Username, roles)
+	if err != nil {
+		log.Printf("Error generating access token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+	refreshToken, err := generateRefreshToken(user.ID, user.Username)
+	if err != nil {
+		log.Printf("Error generating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
+		return
+	}
+	// ทุกครั้งที่ login จะได้ family ใหม่ ส่วน token ที่ได้จาก refresh จะอยู่ family เดิม
+	familyID, err := generateRandomID()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
 	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-	_ = storeRefreshToken(user.ID, refreshToken, expiresAt)
+	if err := storeRefreshToken(user.ID, refreshToken, familyID, expiresAt); err != nil {
+		log.Printf("Error storing refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
 	db.Exec("UPDATE users SET last_login = NOW() WHERE id = $1", user.ID)
 	logAudit(user.ID, "login", "auth", nil, gin.H{"username": user.Username}, c)
 
 	// Set tokens as httpOnly cookies
-	c.SetCookie("access_token", accessToken, 900, "/", "", false, true)           // 15 minutes
-	c.SetCookie("refresh_token", refreshToken, 604800, "/", "", false, true)      // 7 days
+	csrfToken, err := setAuthCookies(c, accessToken, refreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
 
 	c.JSON(http.StatusOK, gin.H{
-		"user": UserInfo{ID: user.ID, Username: user.Username, Email: user.Email, Roles: roles},
+		"user":       UserInfo{ID: user.ID, Username: user.Username, Email: user.Email, Roles: roles},
+		"csrf_token": csrfToken,
 	})
 }
 
 // ===================== Refresh Token Replacement =====================
-func replaceRefreshToken(oldToken, newToken string) error {
-	query := `
+// revoke token เก่าและบันทึก token ใหม่ใน transaction เดียว (ไม่มีทางที่ token เก่าหายไปแต่ token ใหม่ไม่ถูกเก็บ)
+// คืนค่า false ถ้า token เก่าถูก revoke ไปก่อนแล้ว (มี request อื่น rotate ไปก่อน)
+func replaceRefreshToken(oldToken, newToken string, userID int, familyID string, expiresAt time.Time) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(`
 		UPDATE refresh_tokens
 		SET revoked_at = NOW(), replaced_by = $1
 		WHERE token = $2 AND revoked_at IS NULL
-	`
-	_, err := db.Exec(query, newToken, oldToken)
-	return err
+	`, newToken, oldToken)
+	if err != nil {
+		return false, err
+	}
+	if rows, err := result.RowsAffected(); err != nil || rows == 0 {
+		return false, err
+	}
+
+	if _, err := tx.Exec(
+		"INSERT INTO refresh_tokens (user_id, token, family_id, expires_at) VALUES ($1, $2, $3, $4)",
+		userID, newToken, familyID, expiresAt,
+	); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// ===================== Refresh Token Reuse Detection =====================
+// token ที่ถูก rotate ไปแล้ว (revoked + replaced_by) แต่ยังถูกส่งมาอีก แปลว่าน่าจะโดนขโมย
+// จึง revoke ทั้ง family แล้วบังคับให้ login ใหม่
+func handleRefreshTokenReuse(c *gin.Context, rec *RefreshTokenRecord) {
+	revoked, err := revokeTokenFamily(rec.FamilyID)
+	if err != nil {
+		log.Printf("Error revoking token family: %v", err)
+	}
+
+	logAudit(rec.UserID, "refresh_token_reuse", "security", rec.FamilyID, gin.H{
+		"family_id":      rec.FamilyID,
+		"tokens_revoked": revoked,
+	}, c)
+
+	clearAuthCookies(c)
+	c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token reuse detected, please log in again"})
 }
 
 func refreshTokenHandler(c *gin.Context) {
 	// Read refresh token from cookie
-	oldRefreshToken, err := c.Cookie("refresh_token")
+	oldRefreshToken, err := readCookie(c, "refresh_token")
 	if err != nil {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "refresh token required"})
 		return
 	}
 
-	userID, valid := isRefreshTokenValid(oldRefreshToken)
-	if !valid {
+	rec, err := getRefreshTokenRecord(oldRefreshToken)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+		return
+	}
+	if rec.RevokedAt.Valid && rec.ReplacedBy.Valid {
+		handleRefreshTokenReuse(c, rec)
+		return
+	}
+	if rec.RevokedAt.Valid || time.Now().After(rec.ExpiresAt) {
 		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
 		return
 	}
+	userID := rec.UserID
 
 	var username string
 	_ = db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
 	roles, _ := getUserRoles(userID)
 
-	accessToken, _ := generateAccessToken(userID, username, roles)
-	newRefreshToken, _ := generateRefreshToken(userID, username)
-	_ = replaceRefreshToken(oldRefreshToken, newRefreshToken)
+	accessToken, err := generateAccessToken(userID, username, roles)
+	if err != nil {
+		log.Printf("Error generating access token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+	newRefreshToken, err := generateRefreshToken(userID, username)
+	if err != nil {
+		log.Printf("Error generating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
+		return
+	}
 	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-	_ = storeRefreshToken(userID, newRefreshToken, expiresAt)
-	logAudit(userID, "refresh", "auth", nil, gin.H{"old_refresh_token": oldRefreshToken, "new_refresh_token": newRefreshToken}, c)
+	replaced, err := replaceRefreshToken(oldRefreshToken, newRefreshToken, userID, rec.FamilyID, expiresAt)
+	if err != nil {
+		log.Printf("Error rotating refresh token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	if !replaced {
+		// มีคนใช้ token เดียวกันนี้ rotate ไปพร้อมกัน ถือว่าเป็นการใช้ซ้ำ
+		handleRefreshTokenReuse(c, rec)
+		return
+	}
+	logAudit(userID, "refresh", "auth", nil, gin.H{"old_refresh_token": oldRefreshToken, "new_refresh_token": newRefreshToken, "family_id": rec.FamilyID}, c)
 
-	// Set new tokens as httpOnly cookies
-	c.SetCookie("access_token", accessToken, 900, "/", "", false, true)           // 15 minutes
-	c.SetCookie("refresh_token", newRefreshToken, 604800, "/", "", false, true)  // 7 days
+	// Set new tokens as httpOnly cookies (หมุน csrf token ไปพร้อมกัน)
+	csrfToken, err := setAuthCookies(c, accessToken, newRefreshToken)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "tokens refreshed successfully"})
+	c.JSON(http.StatusOK, gin.H{"message": "tokens refreshed successfully", "csrf_token": csrfToken})
 }
 
 func logout(c *gin.Context) {
 	// Read refresh token from cookie
-	refreshToken, err := c.Cookie("refresh_token")
+	refreshToken, err := readCookie(c, "refresh_token")
 	if err == nil {
 		_ = revokeRefreshToken(refreshToken)
 	}
@@ -368,17 +1393,84 @@ func logout(c *gin.Context) {
 	}
 
 	// Clear cookies by setting MaxAge to -1
-	c.SetCookie("access_token", "", -1, "/", "", false, true)
-	c.SetCookie("refresh_token", "", -1, "/", "", false, true)
+	clearAuthCookies(c)
 
 	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
 }
 
+// ===================== Security Events =====================
+// request ที่ถูกปฏิเสธ บันทึกลง audit_logs (resource = "security") พร้อม IP และ user agent
+// token ที่ไม่ถูกต้องรวบเป็นแถวเดียวต่อ (IP, action) ต่อ SECURITY_EVENT_WINDOW แบบเดียวกับ week13-lab6
+var throttledSecurityActions = map[string]bool{"token_invalid": true, "api_key_invalid": true}
+
+const securityThrottleMaxEntries = 10000
+
+type securityThrottleEntry struct {
+	windowStart time.Time
+	suppressed  int
+}
+
+type securityEventThrottle struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*securityThrottleEntry
+}
+
+var securityThrottle = &securityEventThrottle{
+	window:  getEnvDuration("SECURITY_EVENT_WINDOW", time.Minute),
+	entries: map[string]*securityThrottleEntry{},
+}
+
+// คืน true ถ้าควรบันทึก พร้อมจำนวน event ที่ถูกรวบไว้จากช่วงก่อนหน้า
+func (t *securityEventThrottle) allow(key string, now time.Time) (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if ok && now.Sub(entry.windowStart) < t.window {
+		entry.suppressed++
+		return false, 0
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	if !ok && len(t.entries) >= securityThrottleMaxEntries {
+		// จำกัด memory: ทิ้ง entry ที่หมดช่วงแล้ว (ยอดที่รวบไว้ของ entry เหล่านั้นจะไม่ถูกบันทึก)
+		for k, e := range t.entries {
+			if now.Sub(e.windowStart) >= t.window {
+				delete(t.entries, k)
+			}
+		}
+	}
+	t.entries[key] = &securityThrottleEntry{windowStart: now}
+	return true, suppressed
+}
+
+func logSecurityEvent(c *gin.Context, userID int, action string, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	if throttledSecurityActions[action] {
+		allowed, suppressed := securityThrottle.allow(c.ClientIP()+"|"+action, time.Now())
+		if !allowed {
+			return
+		}
+		if suppressed > 0 {
+			details["suppressed"] = suppressed
+		}
+	}
+	details["method"] = c.Request.Method
+	details["path"] = c.Request.URL.Path
+	logAudit(userID, action, "security", nil, details, c)
+}
+
 // ===================== Middleware =====================
 func authMiddleware() gin.HandlerFunc {
 	return func(c *gin.Context) {
 		// Read token from cookie
-		tokenString, err := c.Cookie("access_token")
+		tokenString, err := readCookie(c, "access_token")
 		if err != nil {
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "access token required"})
 			c.Abort()
@@ -387,6 +1479,11 @@ func authMiddleware() gin.HandlerFunc {
 
 		claims, err := verifyToken(tokenString)
 		if err != nil {
+			reason := "invalid"
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				reason = "expired"
+			}
+			logSecurityEvent(c, 0, "token_invalid", gin.H{"reason": reason})
 			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
 			c.Abort()
 			return
@@ -407,6 +1504,7 @@ func requirePermission(permission string) gin.HandlerFunc {
 			return
 		}
 		if !checkUserPermission(userID.(int), permission) {
+			logSecurityEvent(c, userID.(int), "permission_denied", gin.H{"required": permission})
 			c.JSON(http.StatusForbidden, gin.H{"error": "insufficient permissions", "required": permission})
 			c.Abort()
 			return
@@ -582,21 +1680,40 @@ func deleteBook(c *gin.Context) {
 // @host            localhost:8080
 // @BasePath        /api/v1
 func main() {
+	initRedaction()
+	initBcryptCost()
+	initJWTKeys()
+	initCookieConfig()
 	initDB()
 	defer db.Close()
 
+	// request log, panic dump และ log ทั่วไปผ่าน redaction ก่อนพิมพ์
+	gin.DefaultWriter = redactingWriter{os.Stdout}
+	gin.DefaultErrorWriter = redactingWriter{os.Stderr}
+	log.SetOutput(redactingWriter{os.Stderr})
+
 	r := gin.Default()
-	r.Use(cors.Default())
+	// ค่า default ของ gin เชื่อ X-Forwarded-For จากทุกที่ ใครก็ปลอม IP ได้ (ข้าม lockout ราย IP หรือล็อค IP คนอื่น)
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES: ", err)
+	}
+	r.Use(cors.New(corsConfig()))
+	r.Use(redactErrorResponses())
 
 	// ===================== Public Endpoints =====================
 	// Swagger documentation
 	r.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	// Public keys สำหรับ verify JWT (service อื่นใช้ได้โดยไม่ต้องมี secret)
+	r.GET("/.well-known/jwks.json", jwksHandler)
+
 	// Health check endpoint (for Docker healthcheck)
 	r.GET("/health", func(c *gin.Context){
 		err := db.Ping()
 		if err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"message":"unhealthy", "error":err.Error()})
+			// รายละเอียด error ของ DB ไว้ใน log เท่านั้น endpoint นี้ไม่ต้อง authenticate
+			log.Printf("Health check failed: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message":"unhealthy"})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message" : "healthy"})
@@ -606,13 +1723,14 @@ func main() {
 	auth := r.Group("/auth")
 	{
 		auth.POST("/login", login)           // Login และรับ tokens
-		auth.POST("/refresh", refreshTokenHandler)  // Refresh access token
-		auth.POST("/logout", logout)         // Logout และ revoke token
+		auth.POST("/refresh", csrfMiddleware(), refreshTokenHandler)  // Refresh access token (ต้องมี X-CSRF-Token)
+		auth.POST("/logout", csrfMiddleware(), logout)         // Logout และ revoke token
 	}
 
 	// ===================== Protected API Endpoints =====================
 	api := r.Group("/api/v1")
 	api.Use(authMiddleware()) // ทุก endpoint ต้อง authenticate
+	api.Use(csrfMiddleware()) // POST/PUT/DELETE ต้องส่ง X-CSRF-Token ให้ตรงกับ cookie csrf_token
 	{
 		// Books endpoints with permission checks
 		api.GET("/books",
@@ -634,6 +1752,15 @@ func main() {
 		api.DELETE("/books/:id",
 			requirePermission("books:delete"),
 			deleteBook)
+
+		// ปลดล็อค login ที่ถูกล็อคจากการใส่รหัสผิดหลายครั้ง
+		api.GET("/lockouts",
+			requirePermission("users:read"),
+			listLockouts)
+
+		api.POST("/lockouts/unlock",
+			requirePermission("users:update"),
+			unlockLogin)
 	}
 
 	r.Run(":8080")
@@ -0,0 +1,12 @@
+-- 10. Refresh Token Families (ตรวจจับการนำ refresh token ที่ถูก rotate ไปแล้วกลับมาใช้ซ้ำ)
+-- token ทุกตัวที่ rotate ต่อกันมาจากการ login ครั้งเดียวกันจะอยู่ family เดียวกัน
+ALTER TABLE refresh_tokens ADD COLUMN family_id VARCHAR(64);
+
+-- token เดิมที่มีอยู่แล้วให้แต่ละตัวเป็น family ของตัวเอง
+UPDATE refresh_tokens SET family_id = 'legacy-' || id WHERE family_id IS NULL;
+
+-- service อื่นที่ใช้ตารางเดียวกัน (week13-lab6) ไม่ได้ส่ง family_id มา ให้แต่ละ token เป็น family ของตัวเอง
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET DEFAULT 'legacy-' || gen_random_uuid();
+ALTER TABLE refresh_tokens ALTER COLUMN family_id SET NOT NULL;
+
+CREATE INDEX idx_refresh_tokens_family ON refresh_tokens(family_id);
@@ -0,0 +1,86 @@
+package main
+
+import "testing"
+
+func setupRedaction(t *testing.T) {
+	t.Helper()
+	t.Setenv("REDACT_FIELDS", "")
+	t.Setenv("REDACT_PATTERNS", "")
+	initRedaction()
+}
+
+func TestIsSensitiveField(t *testing.T) {
+	setupRedaction(t)
+
+	tests := []struct {
+		key  string
+		want bool
+	}{
+		{"password", true},
+		{"Password", true},
+		{"new_password", true},
+		{"password_hash", true},
+		{"refresh_token", true},
+		{"csrf_token", true},
+		{"Authorization", true},
+		{"x_api_key_id", true},
+		{"client_secret", true},
+		{"username", false},
+		{"author", false},
+		{"tokens", false},
+		{"passwords", false},
+		{"refresh_tokens_revoked", false},
+		{"", false},
+	}
+
+	for _, tt := range tests {
+		if got := isSensitiveField(tt.key); got != tt.want {
+			t.Errorf("isSensitiveField(%q) = %v, want %v", tt.key, got, tt.want)
+		}
+	}
+}
+
+func TestRedactString(t *testing.T) {
+	setupRedaction(t)
+
+	tests := []struct {
+		name, in, want string
+	}{
+		{"plain text", "login failed", "login failed"},
+		{"query string", "password=hunter2&user=bob", "password=[REDACTED]&user=bob"},
+		{"cookie header", "access_token=abc; theme=dark", "access_token=[REDACTED]; theme=dark"},
+		{"json field", `{"refresh_token": "abc", "user": "bob"}`, `{"refresh_token":"[REDACTED]", "user": "bob"}`},
+		{"bearer header", "Authorization: Bearer abc.def-ghi", "Authorization: Bearer [REDACTED]"},
+		{"bare jwt", "got eyJhbGciOiJIUzI1NiJ9.eyJzdWIiOiIxIn0.sig", "got [REDACTED_JWT]"},
+		{"email", "sent to alice@example.com", "sent to [REDACTED_EMAIL]"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := redactString(tt.in); got != tt.want {
+				t.Errorf("redactString(%q) = %q, want %q", tt.in, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestRedactStringCustomPattern(t *testing.T) {
+	t.Setenv("REDACT_FIELDS", "ssn")
+	t.Setenv("REDACT_PATTERNS", `\b\d{13}\b`)
+	initRedaction()
+	defer setupRedaction(t)
+
+	tests := []struct {
+		in, want string
+	}{
+		{"ssn=123456789", "ssn=[REDACTED]"},
+		{"citizen id 1234567890123", "citizen id [REDACTED]"},
+		{"order 12345", "order 12345"},
+	}
+
+	for _, tt := range tests {
+		if got := redactString(tt.in); got != tt.want {
+			t.Errorf("redactString(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
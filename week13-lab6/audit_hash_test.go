@@ -0,0 +1,99 @@
+package main
+
+import (
+	"encoding/json"
+	"testing"
+	"time"
+)
+
+// hash ของ record ใน TestAuditHashGolden ต้องตรงกันทั้ง week13-lab6 และ week13-assignment
+// ถ้าเปลี่ยนรูปแบบที่ใช้คำนวณ hash chain เดิมใน DB จะ verify ไม่ผ่าน
+const auditGoldenHash = "697aa070c957c2e12a5f1e46b6f0823fd868778d755d479e9180564bbfdd57c1"
+
+func intPtr(v int) *int { return &v }
+
+func TestAuditHashRoundTrip(t *testing.T) {
+	// ตอนเขียน: เวลามี nanosecond และ timezone ของเครื่อง (appendAuditRecords ตัดเหลือ microsecond UTC)
+	written := time.Date(2026, 3, 1, 9, 30, 15, 123456789, time.FixedZone("ICT", 7*3600))
+	// ตอนอ่านกลับ: Postgres เก็บแค่ microsecond และคืน location ตาม session
+	readBack := time.Date(2026, 3, 1, 2, 30, 15, 123456000, time.FixedZone("", 0))
+
+	tests := []struct {
+		name      string
+		userID    *int
+		details   string // JSON ที่ logAudit ส่งเข้า canonicalJSON
+		jsonbText string // details แบบที่ jsonb คืนกลับมา (เรียง key ใหม่ + เว้นวรรค)
+	}{
+		{"key order and whitespace", intPtr(7), `{"username":"alice","role":"admin","count":3}`, `{"role": "admin", "count": 3, "username": "alice"}`},
+		{"html characters", intPtr(7), `{"q":"<script>&"}`, `{"q": "<script>&"}`},
+		{"thai", intPtr(7), `{"reason":"รหัสผ่านผิด"}`, `{"reason": "รหัสผ่านผิด"}`},
+		{"nested", intPtr(7), `{"b":{"y":1,"x":[1,2]},"a":null}`, `{"a": null, "b": {"x": [1, 2], "y": 1}}`},
+		{"nil user id", nil, `{"username":"ghost"}`, `{"username": "ghost"}`},
+		{"null details", intPtr(7), `null`, `null`},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			stored := &auditRecord{
+				ID: 42, PrevHash: "abc", UserID: tt.userID,
+				Action: "login", Resource: "auth", ResourceID: "7",
+				Details:   canonicalJSON([]byte(tt.details)),
+				IPAddress: "10.0.0.1", UserAgent: "curl/8.0",
+				CreatedAt: written.UTC().Truncate(time.Microsecond),
+			}
+			loaded := *stored
+			loaded.Details = json.RawMessage(tt.jsonbText)
+			loaded.CreatedAt = readBack
+
+			if got, want := loaded.computeHash(), stored.computeHash(); got != want {
+				t.Errorf("hash after round trip = %s, want %s", got, want)
+			}
+		})
+	}
+}
+
+func TestAuditHashGolden(t *testing.T) {
+	record := &auditRecord{
+		ID: 1, PrevHash: "", UserID: intPtr(1),
+		Action: "create", Resource: "books", ResourceID: "5",
+		Details:   json.RawMessage(`{"title": "Go <101> & ภาษาไทย"}`),
+		IPAddress: "127.0.0.1", UserAgent: "test",
+		CreatedAt: time.Date(2026, 1, 2, 3, 4, 5, 6000, time.UTC),
+	}
+	if got := record.computeHash(); got != auditGoldenHash {
+		t.Errorf("computeHash() = %s, want %s", got, auditGoldenHash)
+	}
+}
+
+func TestAuditHashDetectsTampering(t *testing.T) {
+	base := auditRecord{
+		ID: 42, PrevHash: "abc", UserID: intPtr(7),
+		Action: "login", Resource: "auth", ResourceID: "7",
+		Details:   json.RawMessage(`{"username":"alice"}`),
+		IPAddress: "10.0.0.1", UserAgent: "curl/8.0",
+		CreatedAt: time.Date(2026, 3, 1, 2, 30, 15, 123456000, time.UTC),
+	}
+	want := base.computeHash()
+
+	tests := []struct {
+		name   string
+		tamper func(r *auditRecord)
+	}{
+		{"id", func(r *auditRecord) { r.ID = 43 }},
+		{"prev hash", func(r *auditRecord) { r.PrevHash = "abd" }},
+		{"user id", func(r *auditRecord) { r.UserID = intPtr(8) }},
+		{"user id removed", func(r *auditRecord) { r.UserID = nil }},
+		{"action", func(r *auditRecord) { r.Action = "logout" }},
+		{"details", func(r *auditRecord) { r.Details = json.RawMessage(`{"username":"bob"}`) }},
+		{"ip address", func(r *auditRecord) { r.IPAddress = "10.0.0.2" }},
+		{"created at", func(r *auditRecord) { r.CreatedAt = r.CreatedAt.Add(time.Microsecond) }},
+	}
+
+	for _, tt := range tests {
+		record := base
+		tt.tamper(&record)
+		if record.computeHash() == want {
+			t.Errorf("tampering with %s did not change the hash", tt.name)
+		}
+	}
+}
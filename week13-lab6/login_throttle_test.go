@@ -0,0 +1,34 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLoginBackoff(t *testing.T) {
+	origBase, origMax := loginBackoffBase, loginBackoffMax
+	loginBackoffBase, loginBackoffMax = time.Second, 30*time.Second
+	defer func() { loginBackoffBase, loginBackoffMax = origBase, origMax }()
+
+	tests := []struct {
+		failedCount int
+		want        time.Duration
+	}{
+		{-1, 0},
+		{0, 0},
+		{1, time.Second},
+		{2, 2 * time.Second},
+		{3, 4 * time.Second},
+		{5, 16 * time.Second},
+		{6, 30 * time.Second}, // 32s เกิน max
+		{16, 30 * time.Second},
+		{17, 30 * time.Second}, // shift มากกว่านี้ overflow ได้ ต้องคืน max ทันที
+		{1000, 30 * time.Second},
+	}
+
+	for _, tt := range tests {
+		if got := loginBackoff(tt.failedCount); got != tt.want {
+			t.Errorf("loginBackoff(%d) = %v, want %v", tt.failedCount, got, tt.want)
+		}
+	}
+}
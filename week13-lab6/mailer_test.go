@@ -0,0 +1,61 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestOutboxMailerSend(t *testing.T) {
+	tests := []struct {
+		name    string
+		to      string
+		subject string
+		body    string
+	}{
+		{"verification link", "alice@example.com", "Verify your email", "https://localhost:8080/auth/verify-email?token=abc"},
+		{"thai subject", "bob@example.com", "ยืนยันอีเมล", "กดลิงก์เพื่อยืนยัน"},
+		{"empty body", "carol@example.com", "Hello", ""},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// โฟลเดอร์ยังไม่มี mailer ต้องสร้างเอง
+			dir := filepath.Join(t.TempDir(), "outbox")
+			m := &outboxMailer{dir: dir}
+			if err := m.Send(tt.to, tt.subject, tt.body); err != nil {
+				t.Fatalf("Send() error = %v", err)
+			}
+
+			files, err := filepath.Glob(filepath.Join(dir, "*.eml"))
+			if err != nil || len(files) != 1 {
+				t.Fatalf("expected 1 .eml file in outbox, got %v (err %v)", files, err)
+			}
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			msg := string(data)
+			for _, want := range []string{"To: " + tt.to + "\r\n", "Subject: " + tt.subject + "\r\n", "\r\n\r\n" + tt.body + "\r\n"} {
+				if !strings.Contains(msg, want) {
+					t.Errorf("message missing %q:\n%s", want, msg)
+				}
+			}
+		})
+	}
+}
+
+func TestOutboxMailerSendUniqueFiles(t *testing.T) {
+	m := &outboxMailer{dir: t.TempDir()}
+	for i := 0; i < 3; i++ {
+		if err := m.Send("alice@example.com", "Reset your password", "link"); err != nil {
+			t.Fatalf("Send() error = %v", err)
+		}
+	}
+
+	files, _ := filepath.Glob(filepath.Join(m.dir, "*.eml"))
+	if len(files) != 3 {
+		t.Errorf("expected 3 separate messages, got %d", len(files))
+	}
+}
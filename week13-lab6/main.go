@@ -5,12 +5,45 @@ import (
 	"fmt"
 	"os"
 	"database/sql"
-	_ "github.com/lib/pq"
+	"math"
+	"strconv"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"math/big"
+	"sort"
+	"crypto/rand"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"net/url"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/csv"
+	"net/smtp"
+	"path/filepath"
+	"github.com/lib/pq"
 	"log"
 	"github.com/gin-gonic/gin"
 	"net/http"
 	"time"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"errors"
+	"context"
+	"bufio"
+	"os/signal"
+	"syscall"
+	"slices"
+	"regexp"
+	"io"
 	"encoding/json"
 	swaggerFiles "github.com/swaggo/files"
 	ginSwagger "github.com/swaggo/gin-swagger"
@@ -32,18 +65,39 @@ type Book struct {
 	ISBN      string    `json:"isbn"`
 	Year      int       `json:"year"`
 	Price     float64   `json:"price"`
+	CreatedBy *int      `json:"created_by"`
 	CreatedAt time.Time `json:"created_at"`
 	UpdatedAt time.Time `json:"updated_at"`
 }
 
 // ===================== Auth Models =====================
 type User struct {
-	ID           int       `json:"id"`
-	Username     string    `json:"username"`
-	Email        string    `json:"email"`
-	PasswordHash string    `json:"-"` // ไม่ส่งไปใน JSON
-	IsActive     bool      `json:"is_active"`
-	CreatedAt    time.Time `json:"created_at"`
+	ID            int       `json:"id"`
+	Username      string    `json:"username"`
+	Email         string    `json:"email"`
+	PasswordHash  string    `json:"-"` // ไม่ส่งไปใน JSON
+	IsActive      bool      `json:"is_active"`
+	EmailVerified bool      `json:"email_verified"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type RegisterRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=50,alphanum"`
+	Email    string `json:"email" binding:"required,email,max=100"`
+	Password string `json:"password" binding:"required,max=72"` // bcrypt ใช้ได้แค่ 72 bytes
+}
+
+type ResendVerificationRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ForgotPasswordRequest struct {
+	Email string `json:"email" binding:"required,email"`
+}
+
+type ResetPasswordRequest struct {
+	Token       string `json:"token" binding:"required"`
+	NewPassword string `json:"new_password" binding:"required,max=72"`
 }
 
 type LoginRequest struct {
@@ -68,14 +122,177 @@ type RefreshRequest struct {
 	RefreshToken string `json:"refresh_token" binding:"required"`
 }
 
+type UserDetail struct {
+	ID            int        `json:"id"`
+	Username      string     `json:"username"`
+	Email         string     `json:"email"`
+	IsActive      bool       `json:"is_active"`
+	EmailVerified bool       `json:"email_verified"`
+	Roles         []string   `json:"roles"`
+	CreatedAt     time.Time  `json:"created_at"`
+	UpdatedAt     time.Time  `json:"updated_at"`
+	LastLogin     *time.Time `json:"last_login"`
+}
+
+type ImpersonateRequest struct {
+	Reason string `json:"reason" binding:"required,max=500"` // เช่น เลข ticket ที่ลูกค้าแจ้ง
+}
+
+type ImpersonationResponse struct {
+	AccessToken string     `json:"access_token"`
+	ExpiresAt   time.Time  `json:"expires_at"`
+	User        UserDetail `json:"user"`
+	Actor       TokenActor `json:"actor"`
+}
+
+type UserListResponse struct {
+	Data  []UserDetail `json:"data"`
+	Page  int          `json:"page"`
+	Limit int          `json:"limit"`
+	Total int          `json:"total"`
+}
+
+type AuditLog struct {
+	ID         int             `json:"id"`
+	UserID     *int            `json:"user_id"`
+	Username   *string         `json:"username"`
+	Action     string          `json:"action"`
+	Resource   string          `json:"resource"`
+	ResourceID string          `json:"resource_id"`
+	Details    json.RawMessage `json:"details"`
+	IPAddress  string          `json:"ip_address"`
+	UserAgent  string          `json:"user_agent"`
+	CreatedAt  time.Time       `json:"created_at"`
+}
+
+type AuditLogListResponse struct {
+	Data       []AuditLog `json:"data"`
+	Limit      int        `json:"limit"`
+	NextCursor *int       `json:"next_cursor"` // ส่งเป็น ?cursor= เพื่อดึงหน้าถัดไป (null = หมดแล้ว)
+}
+
+type SecuritySummaryIP struct {
+	IPAddress        string    `json:"ip_address"`
+	Total            int       `json:"total"`
+	FailedLogins     int       `json:"failed_logins"`
+	DisabledAccount  int       `json:"disabled_account"`
+	InvalidTokens    int       `json:"invalid_tokens"`
+	PermissionDenied int       `json:"permission_denied"`
+	Accounts         int       `json:"accounts"` // จำนวน account ที่ IP นี้ลอง (สูง = credential stuffing)
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+type SecuritySummaryAccount struct {
+	UserID           *int      `json:"user_id"`
+	Username         string    `json:"username"`
+	Total            int       `json:"total"`
+	FailedLogins     int       `json:"failed_logins"`
+	DisabledAccount  int       `json:"disabled_account"`
+	PermissionDenied int       `json:"permission_denied"`
+	IPAddresses      int       `json:"ip_addresses"` // จำนวน IP ที่ใช้ account นี้
+	LastSeen         time.Time `json:"last_seen"`
+}
+
+type CreateUserRequest struct {
+	Username string `json:"username" binding:"required,min=3,max=50,alphanum"`
+	Email    string `json:"email" binding:"required,email,max=100"`
+	Password string `json:"password" binding:"required,max=72"`
+}
+
+type ChangeEmailRequest struct {
+	Email string `json:"email" binding:"required,email,max=100"`
+}
+
+type AdminPasswordRequest struct {
+	NewPassword string `json:"new_password" binding:"required,max=72"`
+}
+
+type Role struct {
+	ID          int       `json:"id"`
+	Name        string    `json:"name"`
+	Description string    `json:"description"`
+	IsSystem    bool      `json:"is_system"`
+	RequireMFA  bool      `json:"require_mfa"`
+	Permissions []string  `json:"permissions"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+type Permission struct {
+	ID          int    `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	Resource    string `json:"resource"`
+	Action      string `json:"action"`
+}
+
+type CreateRoleRequest struct {
+	Name        string   `json:"name" binding:"required,min=2,max=50"`
+	Description string   `json:"description"`
+	Permissions []string `json:"permissions"`
+}
+
+type RolePermissionRequest struct {
+	Permission string `json:"permission" binding:"required"`
+}
+
+type AssignRoleRequest struct {
+	Role string `json:"role" binding:"required"`
+}
+
+type Session struct {
+	ID         int        `json:"id"`
+	UserAgent  string     `json:"user_agent"`
+	IPAddress  string     `json:"ip_address"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	ExpiresAt  time.Time  `json:"expires_at"`
+}
+
+type APIKey struct {
+	ID         int        `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Scopes     []string   `json:"scopes"`
+	ExpiresAt  *time.Time `json:"expires_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+	CreatedAt  time.Time  `json:"created_at"`
+}
+
+type CreateAPIKeyRequest struct {
+	Name          string   `json:"name" binding:"required,max=100"`
+	Scopes        []string `json:"scopes" binding:"required,min=1"`
+	ExpiresInDays int      `json:"expires_in_days" binding:"omitempty,min=1,max=365"` // ไม่ใส่ = ไม่หมดอายุ
+}
+
+type MFACodeRequest struct {
+	Code string `json:"code" binding:"required"`
+}
+
+type MFALoginRequest struct {
+	MFAToken string `json:"mfa_token" binding:"required"`
+	Code     string `json:"code" binding:"required"` // TOTP 6 หลัก หรือ recovery code
+}
+
+type RoleMFARequest struct {
+	RequireMFA *bool `json:"require_mfa" binding:"required"`
+}
+
 // ===================== JWT Claims =====================
 type CustomClaims struct {
-	UserID   int      `json:"user_id"`
-	Username string   `json:"username"`
-	Roles    []string `json:"roles"`
+	UserID   int         `json:"user_id"`
+	Username string      `json:"username"`
+	Roles    []string    `json:"roles"`
+	Purpose  string      `json:"purpose,omitempty"` // ว่าง = access token, "mfa_login"/"mfa_enroll" = MFA challenge
+	Act      *TokenActor `json:"act,omitempty"`     // มีค่าเมื่อเป็น impersonation token: คนที่ใช้งานจริง
 	jwt.RegisteredClaims
 }
 
+// ผู้ใช้ตัวจริงเบื้องหลัง impersonation token (แนวเดียวกับ "act" claim ใน RFC 8693)
+type TokenActor struct {
+	UserID   int    `json:"user_id"`
+	Username string `json:"username"`
+}
+
 
 func getEnv(key, defaultValue string) string {
 	if value := os.Getenv(key); value != "" {
@@ -84,592 +301,4923 @@ func getEnv(key, defaultValue string) string {
 	return defaultValue
 }
 
-var db *sql.DB
-var jwtSecret = []byte("my-super-secret-key-change-in-production-2024")
-
-// ===================== Password Hashing Functions =====================
-func hashPassword(password string) (string, error) {
-	hash, err := bcrypt.GenerateFromPassword([]byte(password), 12)
-	if err != nil {
-		return "", err
+// ค่าที่คั่นด้วย comma (ตัดช่องว่างและค่าว่างทิ้ง)
+func getEnvList(key, defaultValue string) []string {
+	var values []string
+	for _, value := range strings.Split(getEnv(key, defaultValue), ",") {
+		if value = strings.TrimSpace(value); value != "" {
+			values = append(values, value)
+		}
 	}
-	return string(hash), nil
+	return values
 }
 
-func verifyPassword(hashedPassword, password string) error {
-	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+func getEnvInt(key string, defaultValue int) int {
+	if value, err := strconv.Atoi(os.Getenv(key)); err == nil {
+		return value
+	}
+	return defaultValue
 }
 
-// ===================== JWT Functions =====================
-func generateAccessToken(userID int, username string, roles []string) (string, error) {
-	expirationTime := time.Now().Add(15 * time.Minute)
-
-	claims := &CustomClaims{
-		UserID:   userID,
-		Username: username,
-		Roles:    roles,
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "bookstore-api",
-		},
+func getEnvDuration(key string, defaultValue time.Duration) time.Duration {
+	if value, err := time.ParseDuration(os.Getenv(key)); err == nil {
+		return value
 	}
-
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+	return defaultValue
 }
 
-func generateRefreshToken(userID int, username string) (string, error) {
-	expirationTime := time.Now().Add(7 * 24 * time.Hour)
+var db *sql.DB
+var dbConnString string
+var jwtSecret = []byte("my-super-secret-key-change-in-production-2024")
 
-	claims := &CustomClaims{
-		UserID:   userID,
-		Username: username,
-		Roles:    []string{}, // Refresh token ไม่ต้องเก็บ roles
-		RegisteredClaims: jwt.RegisteredClaims{
-			ExpiresAt: jwt.NewNumericDate(expirationTime),
-			IssuedAt:  jwt.NewNumericDate(time.Now()),
-			Issuer:    "bookstore-api",
-		},
-	}
+// ===================== Redaction =====================
+// ล้างข้อมูลลับก่อนบันทึกลง audit_logs, log และ error response
+// field: ชื่อ key ที่ห้ามเก็บค่า (ตรงตัว หรือเป็นส่วนหนึ่งที่คั่นด้วย _ เช่น refresh_token, password_hash)
+// pattern: ค่าหน้าตาเป็นความลับไม่ว่าจะอยู่ใน field ไหน (JWT, email, Bearer ...)
+// เพิ่มได้ผ่าน REDACT_FIELDS (คั่นด้วย ,) และ REDACT_PATTERNS (regex คั่นด้วยช่องว่าง)
+const redactedValue = "[REDACTED]"
 
-	token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
-	return token.SignedString(jwtSecret)
+type redactPattern struct {
+	re          *regexp.Regexp
+	replacement string
 }
 
-func verifyToken(tokenString string) (*CustomClaims, error) {
-	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, func(token *jwt.Token) (interface{}, error) {
-		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
-			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
-		}
-		return jwtSecret, nil
-	})
+var redaction struct {
+	fields   []string
+	patterns []redactPattern
+}
 
-	if err != nil {
-		return nil, err
+func initRedaction() {
+	redaction.fields = []string{"password", "token", "secret", "authorization", "cookie", "api_key", "csrf"}
+	for _, field := range strings.Split(getEnv("REDACT_FIELDS", ""), ",") {
+		if field = strings.ToLower(strings.TrimSpace(field)); field != "" {
+			redaction.fields = append(redaction.fields, field)
+		}
 	}
 
-	if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
-		return claims, nil
+	// key=value (query string, cookie) และ "key": "value" (JSON) ของ field ที่ห้ามเก็บ
+	fieldNames := make([]string, len(redaction.fields))
+	for i, field := range redaction.fields {
+		fieldNames[i] = regexp.QuoteMeta(field)
 	}
+	fieldKey := `((?:[a-z0-9]+_)*(?:` + strings.Join(fieldNames, "|") + `)(?:_[a-z0-9]+)*)`
 
-	return nil, fmt.Errorf("invalid token")
+	redaction.patterns = []redactPattern{
+		{regexp.MustCompile(`(?i)"` + fieldKey + `"\s*:\s*"[^"]*"`), `"$1":"` + redactedValue + `"`},
+		{regexp.MustCompile(`(?i)\b` + fieldKey + `=[^&;\s"]+`), "$1=" + redactedValue},
+		{regexp.MustCompile(`(?i)\bbearer\s+[A-Za-z0-9._~+/=-]+`), "Bearer " + redactedValue},
+		{regexp.MustCompile(`eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`), "[REDACTED_JWT]"},
+		{regexp.MustCompile(`[A-Za-z0-9._%+-]+@[A-Za-z0-9.-]+\.[A-Za-z]{2,}`), "[REDACTED_EMAIL]"},
+	}
+	for _, pattern := range strings.Fields(getEnv("REDACT_PATTERNS", "")) {
+		re, err := regexp.Compile(pattern)
+		if err != nil {
+			log.Fatalf("invalid REDACT_PATTERNS entry %q: %v", pattern, err)
+		}
+		redaction.patterns = append(redaction.patterns, redactPattern{re, redactedValue})
+	}
 }
 
-// ===================== Database Helper Functions =====================
-func getUserRoles(userID int) ([]string, error) {
-	query := `
-		SELECT r.name
-		FROM roles r
-		JOIN user_roles ur ON r.id = ur.role_id
-		WHERE ur.user_id = $1
-	`
+func isSensitiveField(key string) bool {
+	key = strings.ToLower(key)
+	for _, field := range redaction.fields {
+		if key == field || strings.HasPrefix(key, field+"_") || strings.HasSuffix(key, "_"+field) ||
+			strings.Contains(key, "_"+field+"_") {
+			return true
+		}
+	}
+	return false
+}
 
-	rows, err := db.Query(query, userID)
-	if err != nil {
-		return nil, err
+func redactString(s string) string {
+	for _, p := range redaction.patterns {
+		s = p.re.ReplaceAllString(s, p.replacement)
 	}
-	defer rows.Close()
+	return s
+}
 
-	var roles []string
-	for rows.Next() {
-		var role string
-		if err := rows.Scan(&role); err != nil {
-			return nil, err
+// ไล่ redact ทั้ง map/slice ซ้อนกัน (details ของ audit log)
+func redactValue(key string, value interface{}) interface{} {
+	if isSensitiveField(key) {
+		return redactedValue
+	}
+	switch v := value.(type) {
+	case string:
+		return redactString(v)
+	case map[string]interface{}:
+		return redactDetails(v)
+	case gin.H:
+		return redactDetails(v)
+	case []interface{}:
+		out := make([]interface{}, len(v))
+		for i, item := range v {
+			out[i] = redactValue("", item)
 		}
-		roles = append(roles, role)
+		return out
+	case []string:
+		out := make([]string, len(v))
+		for i, item := range v {
+			out[i] = redactString(item)
+		}
+		return out
 	}
+	return value
+}
 
-	return roles, nil
+func redactDetails(details map[string]interface{}) map[string]interface{} {
+	if details == nil {
+		return nil
+	}
+	out := make(map[string]interface{}, len(details))
+	for key, value := range details {
+		out[key] = redactValue(key, value)
+	}
+	return out
 }
 
-func checkUserPermission(userID int, permission string) bool {
-	query := `
-		SELECT COUNT(*)
-		FROM permissions p
-		JOIN role_permissions rp ON p.id = rp.permission_id
-		JOIN user_roles ur ON rp.role_id = ur.role_id
-		WHERE ur.user_id = $1 AND p.name = $2
-	`
+// ครอบ writer ของ log/gin ให้ทุกบรรทัดผ่าน redactString ก่อนพิมพ์
+type redactingWriter struct {
+	w io.Writer
+}
 
-	var count int
-	err := db.QueryRow(query, userID, permission).Scan(&count)
-	if err != nil {
-		log.Printf("Error checking permission: %v", err)
-		return false
+func (r redactingWriter) Write(p []byte) (int, error) {
+	if _, err := r.w.Write([]byte(redactString(string(p)))); err != nil {
+		return 0, err
 	}
+	return len(p), nil
+}
 
-	return count > 0
+// server error ทุกอันผ่านตรงนี้ (status >= 500) ไม่ต้องพึ่งให้ทุก handler จำเรียก redactString เอง
+// เช่น err.Error() จาก DB ที่อาจมี connection string หรือค่าใน query ติดมา
+// 4xx ไม่แตะ เพราะ body อาจมีค่าที่ client ต้องใช้ต่อ (เช่น mfa_token ของ 403 mfa_enroll)
+type redactingResponseWriter struct {
+	gin.ResponseWriter
 }
 
-func storeRefreshToken(userID int, token string, expiresAt time.Time) error {
-	query := `
-		INSERT INTO refresh_tokens (user_id, token, expires_at)
-		VALUES ($1, $2, $3)
-	`
-	_, err := db.Exec(query, userID, token, expiresAt)
-	return err
+func (w redactingResponseWriter) Write(p []byte) (int, error) {
+	if w.Status() < http.StatusInternalServerError {
+		return w.ResponseWriter.Write(p)
+	}
+	if _, err := w.ResponseWriter.Write([]byte(redactString(string(p)))); err != nil {
+		return 0, err
+	}
+	return len(p), nil
 }
 
-func revokeRefreshToken(token string) error {
-	query := `
-		UPDATE refresh_tokens
-		SET revoked_at = NOW()
-		WHERE token = $1 AND revoked_at IS NULL
-	`
-	_, err := db.Exec(query, token)
-	return err
+func (w redactingResponseWriter) WriteString(s string) (int, error) {
+	return w.Write([]byte(s))
 }
 
-func isRefreshTokenValid(token string) (int, bool) {
-	query := `
-		SELECT user_id
-		FROM refresh_tokens
-		WHERE token = $1
-		AND expires_at > NOW()
-		AND revoked_at IS NULL
-	`
+func redactErrorResponses() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		c.Writer = redactingResponseWriter{c.Writer}
+		c.Next()
+	}
+}
 
-	var userID int
-	err := db.QueryRow(query, token).Scan(&userID)
-	if err != nil {
-		return 0, false
+// ===================== Password Hashing Functions =====================
+// cost ปรับขึ้นได้ทีหลัง hash เก่าจะถูก rehash ตอน login (ดู needsRehash)
+var bcryptCost = getEnvInt("BCRYPT_COST", 12)
+
+// bcrypt ใช้ DefaultCost แทนเงียบๆ ถ้า cost ต่ำกว่า MinCost และ error ทุกครั้งถ้าเกิน MaxCost
+// ตั้งค่าผิดต้องพังตั้งแต่ start ไม่ใช่ไปพังตอนสมัคร/เปลี่ยนรหัส
+func initBcryptCost() {
+	if bcryptCost < bcrypt.MinCost || bcryptCost > bcrypt.MaxCost {
+		log.Fatalf("BCRYPT_COST must be between %d and %d, got %d", bcrypt.MinCost, bcrypt.MaxCost, bcryptCost)
 	}
+}
 
-	return userID, true
+func hashPassword(password string) (string, error) {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcryptCost)
+	if err != nil {
+		return "", err
+	}
+	return string(hash), nil
 }
 
-func logAudit(userID int, action, resource string, resourceID interface{}, details map[string]interface{}, c *gin.Context) {
-	detailsJSON, _ := json.Marshal(details)
+func verifyPassword(hashedPassword, password string) error {
+	return bcrypt.CompareHashAndPassword([]byte(hashedPassword), []byte(password))
+}
 
-	query := `
-		INSERT INTO audit_logs
-		(user_id, action, resource, resource_id, details, ip_address, user_agent)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-	`
+// hash ที่ไม่ใช่ bcrypt หรือ cost ต่ำกว่าค่าปัจจุบัน ควรสร้างใหม่
+func needsRehash(hashedPassword string) bool {
+	cost, err := bcrypt.Cost([]byte(hashedPassword))
+	return err != nil || cost < bcryptCost
+}
 
-	var resourceIDStr string
-	if resourceID != nil {
-		resourceIDStr = fmt.Sprintf("%v", resourceID)
+// login สำเร็จ = รู้รหัสจริง จึงเป็นจังหวะเดียวที่ upgrade hash เก่าได้
+// เงื่อนไข password_hash เดิม กันไม่ให้ทับรหัสที่เพิ่งถูกเปลี่ยนไปพร้อมกัน
+func rehashPassword(c *gin.Context, user *User, password string) {
+	if !needsRehash(user.PasswordHash) {
+		return
+	}
+	newHash, err := hashPassword(password)
+	if err != nil {
+		log.Printf("Error rehashing password: %v", err)
+		return
+	}
+	if _, err := db.Exec(
+		"UPDATE users SET password_hash = $1 WHERE id = $2 AND password_hash = $3",
+		newHash, user.ID, user.PasswordHash,
+	); err != nil {
+		log.Printf("Error rehashing password: %v", err)
+		return
 	}
+	logAudit(user.ID, "password_rehash", "users", user.ID, map[string]interface{}{"cost": bcryptCost}, c)
+	user.PasswordHash = newHash
+}
 
-	db.Exec(query,
-		userID,
-		action,
-		resource,
-		resourceIDStr,
-		detailsJSON,
-		c.ClientIP(),
-		c.GetHeader("User-Agent"),
-	)
+// ===================== Password Policy =====================
+var passwordPolicy = struct {
+	MinLength int
+	History   int             // ห้ามซ้ำกับรหัสผ่าน N ครั้งล่าสุด (0 = ไม่ตรวจ)
+	Blocklist map[string]bool // รหัสผ่านที่หลุด/ใช้กันบ่อย (lowercase)
+}{
+	MinLength: getEnvInt("PASSWORD_MIN_LENGTH", 8),
+	History:   getEnvInt("PASSWORD_HISTORY", 5),
 }
 
-func initDB() {
-	var err error
+var errPasswordReused = errors.New("password was used recently, choose a different one")
 
-	host := getEnv("DB_HOST", "")
-	name := getEnv("DB_NAME", "")
-	user := getEnv("DB_USER", "")
-	password := getEnv("DB_PASSWORD", "")
-	port := getEnv("DB_PORT", "")
+// โหลด blocklist จากไฟล์ (บรรทัดละหนึ่งรหัส) ไม่มีไฟล์ก็ทำงานต่อได้แต่ไม่ตรวจ
+func initPasswordPolicy() {
+	passwordPolicy.Blocklist = map[string]bool{}
 
-	conSt := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, name)
-	// fmt.Println(conSt)
-	db, err = sql.Open("postgres", conSt)
+	path := getEnv("PASSWORD_BLOCKLIST_FILE", "./password-blocklist.txt")
+	f, err := os.Open(path)
 	if err != nil {
-		log.Fatal("failed to open database")
+		log.Printf("Password blocklist not loaded (%v)", err)
+		return
 	}
+	defer f.Close()
 
-	// กำหนดจำนวน Connection สูงสุด
-	db.SetMaxOpenConns(25)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		if line := strings.TrimSpace(scanner.Text()); line != "" && !strings.HasPrefix(line, "#") {
+			passwordPolicy.Blocklist[strings.ToLower(line)] = true
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		log.Fatal("failed to read password blocklist: ", err)
+	}
+	log.Printf("Password blocklist loaded: %d entries", len(passwordPolicy.Blocklist))
+}
 
-	// กำหนดจำนวน Idle connection สูงสุด
-	db.SetMaxIdleConns(25)
+// ตรวจกฎที่ไม่ต้องรู้ว่าเป็นของ user คนไหน (ความยาว, blocklist)
+func validatePassword(password string) error {
+	if len([]rune(password)) < passwordPolicy.MinLength {
+		return fmt.Errorf("password must be at least %d characters", passwordPolicy.MinLength)
+	}
+	if len(password) > 72 {
+		return fmt.Errorf("password must be at most 72 bytes")
+	}
+	if passwordPolicy.Blocklist[strings.ToLower(password)] {
+		return fmt.Errorf("password is too common or has appeared in a data breach")
+	}
+	return nil
+}
 
-	// กำหนดอายุของ Connection
-	db.SetConnMaxLifetime(5 * time.Minute)
+// เทียบกับรหัสผ่านปัจจุบันและประวัติ N ครั้งล่าสุด (ใช้ tx เดียวกับที่จะเปลี่ยนรหัส)
+func checkPasswordReuse(tx *sql.Tx, userID interface{}, password string) error {
+	if passwordPolicy.History <= 0 {
+		return nil
+	}
 
-	err = db.Ping()
+	rows, err := tx.Query(`
+		SELECT password_hash FROM users WHERE id = $1
+		UNION ALL
+		(SELECT password_hash FROM password_history WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2)
+	`, userID, passwordPolicy.History)
 	if err != nil {
-		log.Fatal("failed to connect to database", err)
+		return err
 	}
-	log.Println("successfully connected to database")
+	defer rows.Close()
+
+	for rows.Next() {
+		var hash string
+		if err := rows.Scan(&hash); err != nil {
+			return err
+		}
+		if verifyPassword(hash, password) == nil {
+			return errPasswordReused
+		}
+	}
+	return rows.Err()
 }
 
-// ===================== Authentication Endpoints =====================
-func login(c *gin.Context) {
-	var req LoginRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
-		return
+// เก็บ hash ใหม่ลงประวัติ และตัดประวัติที่เก่ากว่า N ครั้งทิ้ง
+func recordPasswordHistory(tx *sql.Tx, userID interface{}, passwordHash string) error {
+	if _, err := tx.Exec("INSERT INTO password_history (user_id, password_hash) VALUES ($1, $2)", userID, passwordHash); err != nil {
+		return err
 	}
+	_, err := tx.Exec(`
+		DELETE FROM password_history
+		WHERE user_id = $1 AND id NOT IN (
+			SELECT id FROM password_history WHERE user_id = $1 ORDER BY created_at DESC, id DESC LIMIT $2
+		)
+	`, userID, max(passwordPolicy.History, 1))
+	return err
+}
 
-	// ดึงข้อมูล user จาก database
-	var user User
+// ===================== JWT Signing Keys =====================
+// ตั้ง JWT_SIGNING_KEY_FILE (PEM: RSA หรือ Ed25519) เพื่อเซ็นด้วย RS256/EdDSA และใส่ kid ใน header
+// JWT_VERIFICATION_KEY_FILES (public key คั่นด้วย comma) คือ key เก่าที่ยัง verify ได้ระหว่าง rotate
+// service อื่นดึง public key จาก /.well-known/jwks.json ไป verify ได้ โดยไม่ต้องรู้ secret
+// ถ้าไม่ตั้งทั้งสองค่าจะใช้ HS256 + jwtSecret แบบเดิม
+type jwtKey struct {
+	kid       string
+	method    jwt.SigningMethod
+	publicKey crypto.PublicKey
+}
+
+type jwtKeyRing struct {
+	signingKid    string
+	signingMethod jwt.SigningMethod
+	signingKey    crypto.Signer
+	verifyKeys    map[string]*jwtKey
+}
+
+var jwtKeys = &jwtKeyRing{verifyKeys: map[string]*jwtKey{}}
+
+type JWK struct {
+	Kty string `json:"kty"`
+	Kid string `json:"kid"`
+	Use string `json:"use"`
+	Alg string `json:"alg"`
+	N   string `json:"n,omitempty"`
+	E   string `json:"e,omitempty"`
+	Crv string `json:"crv,omitempty"`
+	X   string `json:"x,omitempty"`
+}
+
+// kid = SHA-256 ของ public key ทำให้ทุก service คำนวณได้ค่าเดียวกันจาก key เดียวกัน
+func jwtKeyID(pub crypto.PublicKey) (string, error) {
+	der, err := x509.MarshalPKIXPublicKey(pub)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(der)
+	return base64.RawURLEncoding.EncodeToString(sum[:12]), nil
+}
+
+func readPEMBlock(path string) (*pem.Block, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	block, _ := pem.Decode(data)
+	if block == nil {
+		return nil, fmt.Errorf("%s: no PEM data found", path)
+	}
+	return block, nil
+}
+
+func loadPrivateKey(path string) (crypto.Signer, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PRIVATE KEY":
+		key, err := x509.ParsePKCS1PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "PRIVATE KEY":
+		key, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		switch k := key.(type) {
+		case *rsa.PrivateKey:
+			return k, nil
+		case ed25519.PrivateKey:
+			return k, nil
+		}
+		return nil, fmt.Errorf("%s: unsupported private key type %T", path, key)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+func loadPublicKey(path string) (crypto.PublicKey, error) {
+	block, err := readPEMBlock(path)
+	if err != nil {
+		return nil, err
+	}
+
+	switch block.Type {
+	case "RSA PUBLIC KEY":
+		key, err := x509.ParsePKCS1PublicKey(block.Bytes)
+		if err != nil {
+			return nil, err
+		}
+		return key, nil
+	case "PUBLIC KEY":
+		return x509.ParsePKIXPublicKey(block.Bytes)
+	}
+	return nil, fmt.Errorf("%s: unsupported PEM block %q", path, block.Type)
+}
+
+func (r *jwtKeyRing) addVerifyKey(pub crypto.PublicKey) (*jwtKey, error) {
+	var method jwt.SigningMethod
+	switch pub.(type) {
+	case *rsa.PublicKey:
+		method = jwt.SigningMethodRS256
+	case ed25519.PublicKey:
+		method = jwt.SigningMethodEdDSA
+	default:
+		return nil, fmt.Errorf("unsupported public key type %T", pub)
+	}
+
+	kid, err := jwtKeyID(pub)
+	if err != nil {
+		return nil, err
+	}
+	key := &jwtKey{kid: kid, method: method, publicKey: pub}
+	r.verifyKeys[kid] = key
+	return key, nil
+}
+
+func initJWTKeys() {
+	if path := getEnv("JWT_SIGNING_KEY_FILE", ""); path != "" {
+		signer, err := loadPrivateKey(path)
+		if err != nil {
+			log.Fatal("failed to load JWT signing key: ", err)
+		}
+		key, err := jwtKeys.addVerifyKey(signer.Public())
+		if err != nil {
+			log.Fatal("failed to load JWT signing key: ", err)
+		}
+		jwtKeys.signingKid = key.kid
+		jwtKeys.signingMethod = key.method
+		jwtKeys.signingKey = signer
+	}
+
+	for _, path := range strings.Split(getEnv("JWT_VERIFICATION_KEY_FILES", ""), ",") {
+		path = strings.TrimSpace(path)
+		if path == "" {
+			continue
+		}
+		pub, err := loadPublicKey(path)
+		if err != nil {
+			log.Fatal("failed to load JWT verification key: ", err)
+		}
+		if _, err := jwtKeys.addVerifyKey(pub); err != nil {
+			log.Fatal("failed to load JWT verification key: ", err)
+		}
+	}
+
+	if len(jwtKeys.verifyKeys) == 0 {
+		log.Println("JWT keys not configured, using HS256 shared secret")
+		return
+	}
+	// มีแต่ key สำหรับ verify: server จะออก token ไม่ได้เลย ให้พังตั้งแต่ตอน start ดีกว่าไปพังตอน login
+	if jwtKeys.signingKey == nil {
+		log.Fatal("JWT_VERIFICATION_KEY_FILES is set but JWT_SIGNING_KEY_FILE is not")
+	}
+	log.Printf("JWT keys loaded: signing kid=%q, %d verification keys", jwtKeys.signingKid, len(jwtKeys.verifyKeys))
+}
+
+func signToken(claims jwt.Claims) (string, error) {
+	if len(jwtKeys.verifyKeys) == 0 {
+		token := jwt.NewWithClaims(jwt.SigningMethodHS256, claims)
+		return token.SignedString(jwtSecret)
+	}
+	if jwtKeys.signingKey == nil {
+		return "", fmt.Errorf("no JWT signing key configured")
+	}
+
+	token := jwt.NewWithClaims(jwtKeys.signingMethod, claims)
+	token.Header["kid"] = jwtKeys.signingKid
+	return token.SignedString(jwtKeys.signingKey)
+}
+
+// เลือก key จาก kid และบังคับว่า alg ต้องตรงกับชนิดของ key (กัน alg confusion)
+func verificationKey(token *jwt.Token) (interface{}, error) {
+	if len(jwtKeys.verifyKeys) == 0 {
+		if _, ok := token.Method.(*jwt.SigningMethodHMAC); !ok {
+			return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+		}
+		return jwtSecret, nil
+	}
+
+	kid, _ := token.Header["kid"].(string)
+	key, ok := jwtKeys.verifyKeys[kid]
+	if !ok {
+		return nil, fmt.Errorf("unknown key id: %q", kid)
+	}
+	if token.Method.Alg() != key.method.Alg() {
+		return nil, fmt.Errorf("unexpected signing method: %v", token.Header["alg"])
+	}
+	return key.publicKey, nil
+}
+
+func jwksHandler(c *gin.Context) {
+	keys := []JWK{}
+	for _, key := range jwtKeys.verifyKeys {
+		jwk := JWK{Kid: key.kid, Use: "sig", Alg: key.method.Alg()}
+		switch pub := key.publicKey.(type) {
+		case *rsa.PublicKey:
+			jwk.Kty = "RSA"
+			jwk.N = base64.RawURLEncoding.EncodeToString(pub.N.Bytes())
+			jwk.E = base64.RawURLEncoding.EncodeToString(big.NewInt(int64(pub.E)).Bytes())
+		case ed25519.PublicKey:
+			jwk.Kty = "OKP"
+			jwk.Crv = "Ed25519"
+			jwk.X = base64.RawURLEncoding.EncodeToString(pub)
+		}
+		keys = append(keys, jwk)
+	}
+	sort.Slice(keys, func(i, j int) bool { return keys[i].Kid < keys[j].Kid })
+
+	c.Header("Cache-Control", "public, max-age=300")
+	c.JSON(http.StatusOK, gin.H{"keys": keys})
+}
+
+// ===================== JWT Functions =====================
+func generateAccessToken(userID int, username string, roles []string) (string, error) {
+	expirationTime := time.Now().Add(15 * time.Minute)
+
+	claims := &CustomClaims{
+		UserID:   userID,
+		Username: username,
+		Roles:    roles,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "bookstore-api",
+		},
+	}
+
+	return signToken(claims)
+}
+
+// access token ของ target ที่มี act = ผู้ใช้จริง อายุสั้นและไม่มี refresh token
+func generateImpersonationToken(target UserDetail, actor TokenActor, ttl time.Duration) (string, time.Time, error) {
+	expirationTime := time.Now().Add(ttl)
+
+	claims := &CustomClaims{
+		UserID:   target.ID,
+		Username: target.Username,
+		Roles:    target.Roles,
+		Act:      &actor,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "bookstore-api",
+		},
+	}
+
+	token, err := signToken(claims)
+	return token, expirationTime, err
+}
+
+func generateRefreshToken(userID int, username string) (string, error) {
+	expirationTime := time.Now().Add(7 * 24 * time.Hour)
+
+	claims := &CustomClaims{
+		UserID:   userID,
+		Username: username,
+		Roles:    []string{}, // Refresh token ไม่ต้องเก็บ roles
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(expirationTime),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "bookstore-api",
+		},
+	}
+
+	return signToken(claims)
+}
+
+func verifyToken(tokenString string) (*CustomClaims, error) {
+	token, err := jwt.ParseWithClaims(tokenString, &CustomClaims{}, verificationKey)
+
+	if err != nil {
+		return nil, err
+	}
+
+	if claims, ok := token.Claims.(*CustomClaims); ok && token.Valid {
+		return claims, nil
+	}
+
+	return nil, fmt.Errorf("invalid token")
+}
+
+// ===================== Database Helper Functions =====================
+func getUserRoles(userID int) ([]string, error) {
 	query := `
-		SELECT id, username, email, password_hash, is_active
-		FROM users
-		WHERE username = $1
+		SELECT r.name
+		FROM roles r
+		JOIN user_roles ur ON r.id = ur.role_id
+		WHERE ur.user_id = $1
+	`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	var roles []string
+	for rows.Next() {
+		var role string
+		if err := rows.Scan(&role); err != nil {
+			return nil, err
+		}
+		roles = append(roles, role)
+	}
+
+	return roles, nil
+}
+
+func checkUserPermission(userID int, permission string) bool {
+	permissions, err := getUserPermissions(userID)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		return false
+	}
+
+	return permissionGranted(permissions, permission)
+}
+
+// ===================== Permission Matching =====================
+// grant รูปแบบ resource:action ใช้ * แทนได้ (books:*, *:read, *:*)
+// และ action บางตัวครอบคลุม action อื่นด้วย เช่น books:update ทำให้ books:read ได้ด้วย
+var impliedActions = map[string][]string{
+	"create":  {"read"},
+	"update":  {"read"},
+	"delete":  {"read"},
+	"publish": {"read"},
+	"assign":  {"read"},
+}
+
+func splitPermission(permission string) (string, string) {
+	resource, action, _ := strings.Cut(permission, ":")
+	return resource, action
+}
+
+func matchPermission(grant, required string) bool {
+	if grant == required {
+		return true
+	}
+	grantResource, grantAction := splitPermission(grant)
+	resource, action := splitPermission(required)
+	return (grantResource == "*" || grantResource == resource) &&
+		(grantAction == "*" || grantAction == action)
+}
+
+// explainGrant บอกว่า grant หนึ่งตัวครอบคลุม permission ที่ต้องการหรือไม่ และเพราะอะไร
+func explainGrant(grant, required string) (string, bool) {
+	if grant == required {
+		return "exact match", true
+	}
+	if matchPermission(grant, required) {
+		return "wildcard match", true
+	}
+
+	resource, action := splitPermission(required)
+	for parent, implied := range impliedActions {
+		for _, a := range implied {
+			if a == action && matchPermission(grant, resource+":"+parent) {
+				return fmt.Sprintf("implied by %s:%s", resource, parent), true
+			}
+		}
+	}
+	return "", false
+}
+
+func permissionGranted(grants map[string]bool, required string) bool {
+	if grants[required] {
+		return true
+	}
+	for grant := range grants {
+		if _, ok := explainGrant(grant, required); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// ===================== Permission Cache =====================
+// เก็บ permissions ของแต่ละ user ไว้ใน memory แทนการ join 3 ตารางทุก request
+// ล้าง cache ผ่าน LISTEN/NOTIFY (trigger ใน migration11) และหมดอายุเองตาม TTL เผื่อพลาด notification
+var permissionCacheTTL = getEnvDuration("PERMISSION_CACHE_TTL", time.Minute)
+
+const permissionsChannel = "permissions_changed"
+
+type cachedPermissions struct {
+	permissions map[string]bool
+	expiresAt   time.Time
+}
+
+var permissionCache = struct {
+	sync.RWMutex
+	entries map[int]cachedPermissions
+}{entries: make(map[int]cachedPermissions)}
+
+func loadUserPermissions(userID int) (map[string]bool, error) {
+	query := `
+		SELECT DISTINCT p.name
+		FROM permissions p
+		JOIN role_permissions rp ON p.id = rp.permission_id
+		JOIN user_roles ur ON rp.role_id = ur.role_id
+		WHERE ur.user_id = $1
+	`
+
+	rows, err := db.Query(query, userID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	permissions := make(map[string]bool)
+	for rows.Next() {
+		var name string
+		if err := rows.Scan(&name); err != nil {
+			return nil, err
+		}
+		permissions[name] = true
+	}
+
+	return permissions, rows.Err()
+}
+
+func getUserPermissions(userID int) (map[string]bool, error) {
+	permissionCache.RLock()
+	entry, ok := permissionCache.entries[userID]
+	permissionCache.RUnlock()
+	if ok && time.Now().Before(entry.expiresAt) {
+		return entry.permissions, nil
+	}
+
+	permissions, err := loadUserPermissions(userID)
+	if err != nil {
+		return nil, err
+	}
+
+	permissionCache.Lock()
+	permissionCache.entries[userID] = cachedPermissions{
+		permissions: permissions,
+		expiresAt:   time.Now().Add(permissionCacheTTL),
+	}
+	permissionCache.Unlock()
+
+	return permissions, nil
+}
+
+// payload เป็น user_id หรือ "*" (ล้างทั้งหมด)
+func invalidatePermissionCache(payload string) {
+	permissionCache.Lock()
+	defer permissionCache.Unlock()
+
+	userID, err := strconv.Atoi(payload)
+	if err != nil {
+		permissionCache.entries = make(map[int]cachedPermissions)
+		return
+	}
+	delete(permissionCache.entries, userID)
+}
+
+// ฟังการเปลี่ยนแปลง role/permission จาก Postgres เพื่อให้ทุก replica เห็นตรงกัน
+func listenForPermissionChanges() {
+	listener := pq.NewListener(dbConnString, 10*time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			log.Printf("Permission listener error: %v", err)
+		}
+	})
+
+	go func() {
+		// Listen รอจนกว่าจะต่อ database ได้ จึงต้องอยู่ใน goroutine
+		if err := listener.Listen(permissionsChannel); err != nil {
+			log.Printf("Error listening for permission changes (falling back to TTL): %v", err)
+			return
+		}
+
+		for {
+			select {
+			case n := <-listener.Notify:
+				// n == nil หมายถึง connection หลุดแล้วต่อใหม่ อาจพลาด notification ไปจึงล้างทั้งหมด
+				if n == nil {
+					invalidatePermissionCache("*")
+					continue
+				}
+				invalidatePermissionCache(n.Extra)
+			case <-time.After(90 * time.Second):
+				go listener.Ping()
+			}
+		}
+	}()
+}
+
+func storeRefreshToken(userID int, token string, expiresAt time.Time, c *gin.Context) error {
+	query := `
+		INSERT INTO refresh_tokens (user_id, token, expires_at, user_agent, ip_address, last_used_at)
+		VALUES ($1, $2, $3, $4, $5, NOW())
 	`
+	_, err := db.Exec(query, userID, token, expiresAt, c.GetHeader("User-Agent"), c.ClientIP())
+	return err
+}
+
+func revokeRefreshToken(token string) error {
+	query := `
+		UPDATE refresh_tokens
+		SET revoked_at = NOW()
+		WHERE token = $1 AND revoked_at IS NULL
+	`
+	_, err := db.Exec(query, token)
+	return err
+}
+
+func isRefreshTokenValid(token string) (int, bool) {
+	// อัพเดท last_used_at ไปพร้อมกันเพื่อแสดงในรายการ sessions
+	query := `
+		UPDATE refresh_tokens
+		SET last_used_at = NOW()
+		WHERE token = $1
+		AND expires_at > NOW()
+		AND revoked_at IS NULL
+		RETURNING user_id
+	`
+
+	var userID int
+	err := db.QueryRow(query, token).Scan(&userID)
+	if err != nil {
+		return 0, false
+	}
+
+	return userID, true
+}
+
+func logAudit(userID int, action, resource string, resourceID interface{}, details map[string]interface{}, c *gin.Context) {
+	details = redactDetails(details)
+	detailsJSON, _ := json.Marshal(details)
+
+	record := &auditRecord{
+		Action:    action,
+		Resource:  resource,
+		Details:   canonicalJSON(detailsJSON),
+		IPAddress: c.ClientIP(),
+		UserAgent: redactString(c.GetHeader("User-Agent")),
+		CreatedAt: time.Now(),
+	}
+
+	// ระหว่าง impersonate: user_id คือผู้ใช้จริง ส่วน user ที่ถูกสวมรอยเก็บไว้ใน details
+	// request ที่ใช้ API key: เก็บ key ที่ใช้ไว้ใน details ด้วย
+	actorID, apiKeyID := c.GetInt("actor_id"), c.GetInt("api_key_id")
+	if actorID > 0 || apiKeyID > 0 {
+		merged := map[string]interface{}{}
+		for k, v := range details {
+			merged[k] = v
+		}
+		if actorID > 0 {
+			merged["impersonated_user_id"] = c.GetInt("user_id")
+			merged["impersonated_username"] = c.GetString("username")
+			userID = actorID
+		}
+		if apiKeyID > 0 {
+			merged["api_key_id"] = apiKeyID
+		}
+		detailsJSON, _ = json.Marshal(merged)
+		record.Details = canonicalJSON(detailsJSON)
+	}
+
+	// user_id = 0 (เช่น login ด้วย username ที่ไม่มีอยู่) บันทึกเป็น NULL
+	if userID > 0 {
+		record.UserID = &userID
+	}
+
+	if resourceID != nil {
+		record.ResourceID = fmt.Sprintf("%v", resourceID)
+	}
+
+	// เขียนจริงใน background (auditWriter) ไม่ให้ request ต้องรอ DB
+	auditLog.enqueue(record)
+}
+
+// ===================== Audit Hash Chain =====================
+// แต่ละแถวเก็บ hash ของแถวก่อนหน้า (prev_hash) และ hash ของตัวเอง
+// แก้/ลบแถวไหนก็ตาม hash ของแถวนั้นหรือ prev_hash ของแถวถัดไปจะไม่ตรง
+const auditChainLockID = 7311 // pg_advisory_xact_lock: ต่อ chain ได้ทีละ transaction
+
+type auditRecord struct {
+	ID         int64
+	PrevHash   string
+	Hash       string
+	UserID     *int
+	Action     string
+	Resource   string
+	ResourceID string
+	Details    json.RawMessage
+	IPAddress  string
+	UserAgent  string
+	CreatedAt  time.Time
+	Attempts   int `json:",omitempty"` // จำนวนครั้งที่ replay จากไฟล์ spill แล้วไม่ผ่าน (ไม่รวมใน hash)
+}
+
+// jsonb เรียง key และจัด whitespace ใหม่ จึงต้อง decode/encode ด้วย Go ทั้งตอนเขียนและตอนตรวจ
+func canonicalJSON(raw []byte) json.RawMessage {
+	var value interface{}
+	if err := json.Unmarshal(raw, &value); err != nil {
+		return raw
+	}
+	canonical, err := json.Marshal(value)
+	if err != nil {
+		return raw
+	}
+	return canonical
+}
+
+// field เรียงตามลำดับใน struct เสมอ และเวลาเป็น UTC ความละเอียดเท่ากับ Postgres (microsecond)
+func (r *auditRecord) computeHash() string {
+	canonical, _ := json.Marshal(struct {
+		ID         int64           `json:"id"`
+		PrevHash   string          `json:"prev_hash"`
+		UserID     *int            `json:"user_id"`
+		Action     string          `json:"action"`
+		Resource   string          `json:"resource"`
+		ResourceID string          `json:"resource_id"`
+		Details    json.RawMessage `json:"details"`
+		IPAddress  string          `json:"ip_address"`
+		UserAgent  string          `json:"user_agent"`
+		CreatedAt  string          `json:"created_at"`
+	}{
+		r.ID, r.PrevHash, r.UserID, r.Action, r.Resource, r.ResourceID,
+		canonicalJSON(r.Details), r.IPAddress, r.UserAgent,
+		r.CreatedAt.UTC().Format(time.RFC3339Nano),
+	})
+	sum := sha256.Sum256(canonical)
+	return hex.EncodeToString(sum[:])
+}
+
+// เขียนหลาย record ต่อท้าย chain ใน transaction เดียว (multi-row INSERT)
+// เรียกจาก auditWriter เท่านั้น hash จึงถูกคำนวณตามลำดับที่เขียนจริง
+func appendAuditRecords(records []*auditRecord) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("SELECT pg_advisory_xact_lock($1)", auditChainLockID); err != nil {
+		return err
+	}
+
+	var prevHash string
+	err = tx.QueryRow("SELECT hash FROM audit_logs WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1").Scan(&prevHash)
+	if err != nil && err != sql.ErrNoRows {
+		return err
+	}
+
+	// ต้องรู้ id ก่อน insert เพราะ id เป็นส่วนหนึ่งของ hash
+	rows, err := tx.Query(
+		"SELECT nextval(pg_get_serial_sequence('audit_logs', 'id')) AS id FROM generate_series(1, $1) ORDER BY id",
+		len(records),
+	)
+	if err != nil {
+		return err
+	}
+	for i := 0; rows.Next(); i++ {
+		if err := rows.Scan(&records[i].ID); err != nil {
+			rows.Close()
+			return err
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var values []string
+	var args []interface{}
+	for _, record := range records {
+		record.PrevHash = prevHash
+		record.CreatedAt = record.CreatedAt.UTC().Truncate(time.Microsecond)
+		record.Hash = record.computeHash()
+		prevHash = record.Hash
+
+		placeholders := make([]string, 11)
+		for i := range placeholders {
+			placeholders[i] = fmt.Sprintf("$%d", len(args)+i+1)
+		}
+		values = append(values, "("+strings.Join(placeholders, ", ")+")")
+		args = append(args, record.ID, record.UserID, record.Action, record.Resource, record.ResourceID, []byte(record.Details),
+			record.IPAddress, record.UserAgent, record.CreatedAt, record.PrevHash, record.Hash)
+	}
+
+	_, err = tx.Exec(`
+		INSERT INTO audit_logs
+		(id, user_id, action, resource, resource_id, details, ip_address, user_agent, created_at, prev_hash, hash)
+		VALUES `+strings.Join(values, ", "), args...)
+	if err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+// ===================== Async Audit Writer =====================
+// logAudit ใส่ record ลง queue (bounded) แล้ว goroutine เดียวเขียนลง DB ทีละ batch
+// queue เต็ม = รอสักพัก (backpressure) ถ้ายังเต็มอยู่ หรือ DB ล่ม จะเขียนลงไฟล์ spill ไว้ก่อน
+// แล้วค่อย replay เข้า DB เมื่อเขียนได้อีกครั้ง (drop เฉพาะตอนเขียนไฟล์ไม่ได้)
+type auditWriter struct {
+	queue          chan *auditRecord
+	batchSize      int
+	flushInterval  time.Duration
+	enqueueTimeout time.Duration
+	spillPath      string
+	deadLetterPath string
+	maxAttempts    int
+
+	mu      sync.RWMutex // กัน enqueue หลังจาก close queue แล้ว
+	closed  bool
+	spillMu sync.Mutex
+	done    chan struct{}
+
+	enqueued      atomic.Int64
+	written       atomic.Int64
+	spilled       atomic.Int64
+	dropped       atomic.Int64
+	failedBatches atomic.Int64
+	deadLettered  atomic.Int64
+}
+
+const auditWriteRetries = 3
+
+var auditLog *auditWriter
+
+func initAuditWriter() {
+	batchSize := getEnvInt("AUDIT_BATCH_SIZE", 100)
+	if batchSize < 1 || batchSize > 1000 {
+		batchSize = 100 // 11 parameter ต่อแถว ต้องไม่เกินลิมิตของ Postgres
+	}
+
+	auditLog = &auditWriter{
+		queue:          make(chan *auditRecord, getEnvInt("AUDIT_QUEUE_SIZE", 10000)),
+		batchSize:      batchSize,
+		flushInterval:  getEnvDuration("AUDIT_FLUSH_INTERVAL", time.Second),
+		enqueueTimeout: getEnvDuration("AUDIT_ENQUEUE_TIMEOUT", 50*time.Millisecond),
+		spillPath:      getEnv("AUDIT_SPILL_FILE", "./audit-spill.ndjson"),
+		deadLetterPath: getEnv("AUDIT_DEAD_LETTER_FILE", "./audit-deadletter.ndjson"),
+		maxAttempts:    getEnvInt("AUDIT_SPILL_MAX_ATTEMPTS", 5),
+		done:           make(chan struct{}),
+	}
+	go auditLog.run()
+}
+
+func (w *auditWriter) enqueue(record *auditRecord) {
+	w.mu.RLock()
+	defer w.mu.RUnlock()
+
+	if w.closed {
+		w.spill([]*auditRecord{record})
+		return
+	}
+
+	select {
+	case w.queue <- record:
+		w.enqueued.Add(1)
+		return
+	default:
+	}
+
+	timer := time.NewTimer(w.enqueueTimeout)
+	defer timer.Stop()
+	select {
+	case w.queue <- record:
+		w.enqueued.Add(1)
+	case <-timer.C:
+		w.spill([]*auditRecord{record})
+	}
+}
+
+func (w *auditWriter) run() {
+	defer close(w.done)
+
+	ticker := time.NewTicker(w.flushInterval)
+	defer ticker.Stop()
+
+	// record ที่ค้างในไฟล์จากรอบก่อน (เช่น DB ล่มตอนปิด service)
+	w.replaySpill()
+
+	var batch []*auditRecord
+	for {
+		select {
+		case record, ok := <-w.queue:
+			if !ok {
+				w.flush(batch)
+				return
+			}
+			batch = append(batch, record)
+			if len(batch) >= w.batchSize {
+				w.flush(batch)
+				batch = nil
+			}
+		case <-ticker.C:
+			w.flush(batch)
+			batch = nil
+			w.replaySpill()
+		}
+	}
+}
+
+// ลองเขียนซ้ำแบบ backoff ถ้ายังไม่ได้ก็เก็บลงไฟล์ spill
+func (w *auditWriter) flush(batch []*auditRecord) {
+	if len(batch) == 0 {
+		return
+	}
+
+	var err error
+	for attempt := 0; attempt < auditWriteRetries; attempt++ {
+		if attempt > 0 {
+			time.Sleep(time.Duration(100<<attempt) * time.Millisecond)
+		}
+		if err = appendAuditRecords(batch); err == nil {
+			w.written.Add(int64(len(batch)))
+			return
+		}
+	}
+
+	log.Printf("Error writing %d audit records, spilling to %s: %v", len(batch), w.spillPath, err)
+	w.failedBatches.Add(1)
+	w.spill(batch)
+}
+
+func (w *auditWriter) spill(records []*auditRecord) {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+
+	if err := w.appendSpillFile(records); err != nil {
+		log.Printf("Error spilling audit records, %d dropped: %v", len(records), err)
+		w.dropped.Add(int64(len(records)))
+		return
+	}
+	w.spilled.Add(int64(len(records)))
+}
+
+func (w *auditWriter) appendSpillFile(records []*auditRecord) error {
+	return appendRecordFile(w.spillPath, records)
+}
+
+func appendRecordFile(path string, records []*auditRecord) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	encoder := json.NewEncoder(f)
+	for _, record := range records {
+		if err := encoder.Encode(record); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// อ่านไฟล์ spill แล้วเขียนเข้า DB ทีละ batch (record ที่ยังเขียนไม่ได้ เขียนกลับลงไฟล์ตามเดิม)
+func (w *auditWriter) replaySpill() {
+	records, ok := w.takeSpill()
+	if !ok {
+		return
+	}
+
+	// เขียนเข้า DB โดยไม่ถือ spillMu (request ที่ enqueue ไม่ทันยัง spill ลงไฟล์ใหม่ได้ระหว่างนี้)
+	var remaining []*auditRecord
+	for len(records) > 0 {
+		n := min(w.batchSize, len(records))
+		failed, dbDown := w.replayBatch(records[:n])
+		remaining = append(remaining, failed...)
+		records = records[n:]
+		if dbDown {
+			// DB ล่ม: เก็บทั้งหมดไว้ลองรอบหน้า (ไม่นับเป็น attempt ของ record)
+			remaining = append(remaining, records...)
+			break
+		}
+	}
+
+	// record ที่ยังไม่ได้เข้า DB ต่อท้ายไฟล์ spill กลับไปตามเดิม
+	if len(remaining) > 0 {
+		w.spillMu.Lock()
+		defer w.spillMu.Unlock()
+		if err := w.appendSpillFile(remaining); err != nil {
+			log.Printf("Error rewriting audit spill file, %d dropped: %v", len(remaining), err)
+			w.dropped.Add(int64(len(remaining)))
+		}
+	}
+}
+
+// อ่าน record ทั้งหมดจากไฟล์ spill แล้วลบไฟล์ทิ้งภายใต้ spillMu (ok = false ถ้าไม่มีไฟล์หรืออ่านไม่ได้)
+func (w *auditWriter) takeSpill() ([]*auditRecord, bool) {
+	w.spillMu.Lock()
+	defer w.spillMu.Unlock()
+
+	f, err := os.Open(w.spillPath)
+	if os.IsNotExist(err) {
+		return nil, false
+	} else if err != nil {
+		log.Printf("Error opening audit spill file: %v", err)
+		return nil, false
+	}
+
+	var records []*auditRecord
+	scanner := bufio.NewScanner(f)
+	scanner.Buffer(make([]byte, 64*1024), 10*1024*1024)
+	for scanner.Scan() {
+		var record auditRecord
+		if err := json.Unmarshal(scanner.Bytes(), &record); err != nil {
+			log.Printf("Skipping corrupt audit spill line: %v", err)
+			continue
+		}
+		records = append(records, &record)
+	}
+	f.Close()
+	if err := scanner.Err(); err != nil {
+		log.Printf("Error reading audit spill file: %v", err)
+		return nil, false
+	}
+
+	if err := os.Remove(w.spillPath); err != nil {
+		log.Printf("Error removing audit spill file: %v", err)
+		return nil, false
+	}
+	return records, true
+}
+
+// เขียน batch จากไฟล์ spill ถ้าไม่ผ่านทั้งที่ DB ยังต่อได้ แปลว่ามี record เสียอยู่ในนั้น
+// แบ่งครึ่งไปเรื่อยๆ จนเหลือ record เดียวที่เขียนไม่ได้ แล้วนับ attempt ของ record นั้น
+// ครบ maxAttempts ย้ายไปไฟล์ dead-letter ให้คนมาดูเอง (record เสียตัวเดียวจะได้ไม่ขวางทั้งคิว)
+// คืน record ที่ยังต้องลองใหม่ และ dbDown = true ถ้าเขียนไม่ได้เพราะ DB ล่ม
+func (w *auditWriter) replayBatch(batch []*auditRecord) ([]*auditRecord, bool) {
+	err := appendAuditRecords(batch)
+	if err == nil {
+		w.written.Add(int64(len(batch)))
+		return nil, false
+	}
+	if db.Ping() != nil {
+		return batch, true
+	}
+
+	if len(batch) > 1 {
+		mid := len(batch) / 2
+		failed, dbDown := w.replayBatch(batch[:mid])
+		if dbDown {
+			return append(failed, batch[mid:]...), true
+		}
+		rest, dbDown := w.replayBatch(batch[mid:])
+		return append(failed, rest...), dbDown
+	}
+
+	record := batch[0]
+	record.Attempts++
+	if record.Attempts < w.maxAttempts {
+		return batch, false
+	}
+	log.Printf("Audit record failed %d times, moving to %s: %v", record.Attempts, w.deadLetterPath, err)
+	if err := appendRecordFile(w.deadLetterPath, batch); err != nil {
+		log.Printf("Error writing audit dead-letter file, 1 dropped: %v", err)
+		w.dropped.Add(1)
+		return nil, false
+	}
+	w.deadLettered.Add(1)
+	return nil, false
+}
+
+// ปิด queue แล้วรอให้ writer เขียน record ที่เหลือจนหมด (เรียกตอน shutdown)
+func (w *auditWriter) Close() {
+	w.mu.Lock()
+	if w.closed {
+		w.mu.Unlock()
+		return
+	}
+	w.closed = true
+	close(w.queue)
+	w.mu.Unlock()
+
+	<-w.done
+}
+
+// Prometheus text format
+func auditMetricsHandler(c *gin.Context) {
+	metrics := []struct {
+		name, kind, help string
+		value            int64
+	}{
+		{"audit_queue_depth", "gauge", "Audit records waiting to be written.", int64(len(auditLog.queue))},
+		{"audit_queue_capacity", "gauge", "Maximum number of queued audit records.", int64(cap(auditLog.queue))},
+		{"audit_events_enqueued_total", "counter", "Audit records accepted into the queue.", auditLog.enqueued.Load()},
+		{"audit_events_written_total", "counter", "Audit records written to the database.", auditLog.written.Load()},
+		{"audit_events_spilled_total", "counter", "Audit records written to the spill file.", auditLog.spilled.Load()},
+		{"audit_events_dropped_total", "counter", "Audit records lost because the spill file could not be written.", auditLog.dropped.Load()},
+		{"audit_batch_failures_total", "counter", "Audit batches that failed after all retries.", auditLog.failedBatches.Load()},
+		{"audit_events_dead_lettered_total", "counter", "Audit records moved to the dead-letter file after repeated replay failures.", auditLog.deadLettered.Load()},
+	}
+
+	var b strings.Builder
+	for _, m := range metrics {
+		fmt.Fprintf(&b, "# HELP %s %s\n# TYPE %s %s\n%s %d\n", m.name, m.help, m.name, m.kind, m.name, m.value)
+	}
+	c.Data(http.StatusOK, "text/plain; version=0.0.4", []byte(b.String()))
+}
+
+type AuditChainReport struct {
+	Valid               bool   `json:"valid"`
+	RecordsChecked      int    `json:"records_checked"`
+	CheckpointsVerified int    `json:"checkpoints_verified"`
+	BrokenAt            *int64 `json:"broken_at,omitempty"` // id ของแถวแรกที่ chain ขาด
+	Reason              string `json:"reason,omitempty"`
+	LatestCheckpoint    string `json:"latest_checkpoint,omitempty"` // JWS ให้ auditor ตรวจเองกับ JWKS ได้
+}
+
+func (r *AuditChainReport) broken(id int64, reason string) *AuditChainReport {
+	r.Valid = false
+	r.BrokenAt = &id
+	r.Reason = reason
+	return r
+}
+
+type auditCheckpoint struct {
+	ID        int64
+	LastLogID int64
+	LastHash  string
+	Signature string
+}
+
+// checkpoint ต้องเซ็นด้วย asymmetric key เท่านั้น: HS256 ใช้ secret เดียวกับที่ server ใช้เซ็น
+// ใครได้ secret ไป (หรือคนที่แก้ DB ได้จาก server เดียวกัน) ก็ปลอม checkpoint ได้ auditor ภายนอกก็ตรวจเองไม่ได้
+func checkpointVerificationKey(token *jwt.Token) (interface{}, error) {
+	if _, ok := token.Method.(*jwt.SigningMethodHMAC); ok {
+		return nil, fmt.Errorf("audit checkpoints must not be signed with HMAC")
+	}
+	return verificationKey(token)
+}
+
+// ตรวจลายเซ็นของ checkpoint ทุกอัน คืน checkpoint แยกตาม last_log_id ไว้เทียบระหว่างไล่ chain
+func loadAuditCheckpoints(report *AuditChainReport) (map[int64]auditCheckpoint, bool, error) {
+	rows, err := db.Query("SELECT id, last_log_id, last_hash, signature FROM audit_checkpoints ORDER BY id")
+	if err != nil {
+		return nil, false, err
+	}
+	defer rows.Close()
+
+	checkpoints := map[int64]auditCheckpoint{}
+	for rows.Next() {
+		var cp auditCheckpoint
+		if err := rows.Scan(&cp.ID, &cp.LastLogID, &cp.LastHash, &cp.Signature); err != nil {
+			return nil, false, err
+		}
+
+		claims := jwt.MapClaims{}
+		_, err := jwt.ParseWithClaims(cp.Signature, claims, checkpointVerificationKey)
+		if err != nil || claims["last_hash"] != cp.LastHash || claims["last_log_id"] != float64(cp.LastLogID) {
+			report.broken(cp.LastLogID, fmt.Sprintf("checkpoint %d has an invalid signature", cp.ID))
+			return nil, false, nil
+		}
+		checkpoints[cp.LastLogID] = cp
+		report.LatestCheckpoint = cp.Signature
+	}
+	return checkpoints, true, rows.Err()
+}
+
+// ไล่ตรวจ chain ตั้งแต่แถวแรกที่มี hash ทีละ batch และเทียบกับ checkpoint ที่เซ็นไว้
+func verifyAuditChain() (*AuditChainReport, error) {
+	report := &AuditChainReport{Valid: true}
+	checkpoints, ok, err := loadAuditCheckpoints(report)
+	if err != nil || !ok {
+		return report, err
+	}
+
+	var lastID int64
+	prevHash := ""
+	started := false
+	for {
+		rows, err := db.Query(`
+			SELECT id, COALESCE(prev_hash, ''), COALESCE(hash, ''), user_id, action, COALESCE(resource, ''),
+			       COALESCE(resource_id, ''), COALESCE(details, 'null'::jsonb), COALESCE(ip_address, ''),
+			       COALESCE(user_agent, ''), created_at
+			FROM audit_logs
+			WHERE id > $1
+			ORDER BY id
+			LIMIT $2
+		`, lastID, auditExportBatchSize)
+		if err != nil {
+			return nil, err
+		}
+
+		count := 0
+		for rows.Next() {
+			var record auditRecord
+			var userID sql.NullInt64
+			var details []byte
+			if err := rows.Scan(&record.ID, &record.PrevHash, &record.Hash, &userID, &record.Action, &record.Resource,
+				&record.ResourceID, &details, &record.IPAddress, &record.UserAgent, &record.CreatedAt); err != nil {
+				rows.Close()
+				return nil, err
+			}
+			if userID.Valid {
+				id := int(userID.Int64)
+				record.UserID = &id
+			}
+			record.Details = details
+			lastID = record.ID
+			count++
+
+			// แถวเก่าก่อนเริ่ม chain ข้ามไป แต่หลังจากเริ่มแล้วทุกแถวต้องมี hash
+			if !started && record.Hash == "" {
+				continue
+			}
+			started = true
+			report.RecordsChecked++
+
+			switch {
+			case record.Hash == "":
+				rows.Close()
+				return report.broken(record.ID, "record is not part of the hash chain"), nil
+			case record.PrevHash != prevHash:
+				rows.Close()
+				return report.broken(record.ID, "prev_hash does not match previous record (record inserted or deleted)"), nil
+			case record.computeHash() != record.Hash:
+				rows.Close()
+				return report.broken(record.ID, "hash does not match record contents (record modified)"), nil
+			}
+			if cp, ok := checkpoints[record.ID]; ok {
+				if cp.LastHash != record.Hash {
+					rows.Close()
+					return report.broken(record.ID, fmt.Sprintf("checkpoint %d does not match the chain (records rewritten)", cp.ID)), nil
+				}
+				delete(checkpoints, record.ID)
+				report.CheckpointsVerified++
+			}
+			prevHash = record.Hash
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return nil, err
+		}
+		if count < auditExportBatchSize {
+			break
+		}
+	}
+
+	// checkpoint ที่เหลืออยู่ชี้ไปยังแถวที่ไม่มีแล้ว (ถูกตัดทิ้งจากท้าย chain)
+	for _, cp := range checkpoints {
+		return report.broken(cp.LastLogID, fmt.Sprintf("checkpoint %d points to a missing record (records truncated)", cp.ID)), nil
+	}
+
+	return report, nil
+}
+
+// เซ็น checkpoint ของแถวล่าสุดใน chain (ข้ามถ้าไม่มีแถวใหม่ตั้งแต่ checkpoint ก่อน)
+func createAuditCheckpoint() error {
+	if jwtKeys.signingKey == nil {
+		return fmt.Errorf("audit checkpoints require JWT_SIGNING_KEY_FILE (asymmetric key)")
+	}
+
+	var lastLogID int64
+	var lastHash string
+	err := db.QueryRow("SELECT id, hash FROM audit_logs WHERE hash IS NOT NULL ORDER BY id DESC LIMIT 1").Scan(&lastLogID, &lastHash)
+	if err == sql.ErrNoRows {
+		return nil
+	} else if err != nil {
+		return err
+	}
+
+	var exists bool
+	if err := db.QueryRow("SELECT EXISTS(SELECT 1 FROM audit_checkpoints WHERE last_log_id = $1)", lastLogID).Scan(&exists); err != nil || exists {
+		return err
+	}
+
+	signature, err := signToken(jwt.MapClaims{
+		"typ":         "audit_checkpoint",
+		"last_log_id": lastLogID,
+		"last_hash":   lastHash,
+		"iat":         time.Now().Unix(),
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = db.Exec(
+		"INSERT INTO audit_checkpoints (last_log_id, last_hash, signature) VALUES ($1, $2, $3)",
+		lastLogID, lastHash, signature,
+	)
+	return err
+}
+
+func runAuditCheckpoints() {
+	if jwtKeys.signingKey == nil {
+		log.Println("audit checkpoints disabled: no asymmetric signing key configured (JWT_SIGNING_KEY_FILE)")
+		return
+	}
+
+	ticker := time.NewTicker(getEnvDuration("AUDIT_CHECKPOINT_INTERVAL", time.Hour))
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := createAuditCheckpoint(); err != nil {
+			log.Printf("Error creating audit checkpoint: %v", err)
+		}
+	}
+}
+
+// ===================== One-time Tokens =====================
+// token จริงส่งให้ผู้ใช้ทางอีเมล ส่วนในฐานข้อมูลเก็บแค่ SHA-256
+func generateOneTimeToken() (string, error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// ===================== Mailer =====================
+type Mailer interface {
+	Send(to, subject, body string) error
+}
+
+// outboxMailer เขียนอีเมลเป็นไฟล์ลงโฟลเดอร์ (ใช้แทน SMTP ตอน dev/test แบบ offline)
+type outboxMailer struct {
+	dir string
+}
+
+func (m *outboxMailer) Send(to, subject, body string) error {
+	if err := os.MkdirAll(m.dir, 0o700); err != nil {
+		return err
+	}
+	suffix, err := generateOneTimeToken()
+	if err != nil {
+		return err
+	}
+	name := fmt.Sprintf("%d-%s.eml", time.Now().UnixNano(), suffix[:8])
+	msg := fmt.Sprintf("To: %s\r\nSubject: %s\r\nDate: %s\r\n\r\n%s\r\n", to, subject, time.Now().Format(time.RFC1123Z), body)
+	return os.WriteFile(filepath.Join(m.dir, name), []byte(msg), 0o600)
+}
+
+type smtpMailer struct {
+	addr string
+	from string
+	auth smtp.Auth
+}
+
+func (m *smtpMailer) Send(to, subject, body string) error {
+	msg := fmt.Sprintf("From: %s\r\nTo: %s\r\nSubject: %s\r\n\r\n%s\r\n", m.from, to, subject, body)
+	return smtp.SendMail(m.addr, m.auth, m.from, []string{to}, []byte(msg))
+}
+
+var mailer Mailer
+
+// MAILER=smtp ส่งจริงผ่าน SMTP, ค่าอื่นเขียนลง MAIL_OUTBOX_DIR
+func initMailer() {
+	switch getEnv("MAILER", "outbox") {
+	case "smtp":
+		host := getEnv("SMTP_HOST", "localhost")
+		port := getEnv("SMTP_PORT", "587")
+		var auth smtp.Auth
+		if user := getEnv("SMTP_USER", ""); user != "" {
+			auth = smtp.PlainAuth("", user, getEnv("SMTP_PASSWORD", ""), host)
+		}
+		mailer = &smtpMailer{
+			addr: host + ":" + port,
+			from: getEnv("MAIL_FROM", "no-reply@bookstore.com"),
+			auth: auth,
+		}
+	default:
+		mailer = &outboxMailer{dir: getEnv("MAIL_OUTBOX_DIR", "./outbox")}
+	}
+}
+
+// ===================== Email Verification =====================
+const emailVerificationTTL = 24 * time.Hour
+
+func createEmailVerificationToken(tx *sql.Tx, userID int) (string, error) {
+	token, err := generateOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO email_verification_tokens (user_id, token_hash, expires_at)
+		 VALUES ($1, $2, $3)`,
+		userID, hashToken(token), time.Now().Add(emailVerificationTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+	return token, nil
+}
+
+func sendVerificationEmail(email, token string) error {
+	link := fmt.Sprintf("%s/auth/verify-email?token=%s", getEnv("APP_BASE_URL", "http://localhost:8080"), token)
+	body := fmt.Sprintf("กรุณายืนยันอีเมลของคุณภายใน 24 ชั่วโมง:\r\n%s", link)
+	return mailer.Send(email, "Verify your Bookstore account", body)
+}
+
+// consumeEmailVerificationToken ใช้ token (ครั้งเดียว) แล้วคืน user_id
+func consumeEmailVerificationToken(token string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE email_verification_tokens
+		 SET used_at = NOW()
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		hashToken(token),
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET email_verified = true, updated_at = NOW() WHERE id = $1", userID); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// ===================== Password Reset =====================
+const passwordResetTTL = 30 * time.Minute
+
+func createPasswordResetToken(userID int) (string, error) {
+	token, err := generateOneTimeToken()
+	if err != nil {
+		return "", err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	// ขอใหม่เมื่อไหร่ token เก่าที่ยังไม่ใช้ก็ใช้ไม่ได้อีก
+	if _, err := tx.Exec("UPDATE password_reset_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		return "", err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO password_reset_tokens (user_id, token_hash, expires_at)
+		 VALUES ($1, $2, $3)`,
+		userID, hashToken(token), time.Now().Add(passwordResetTTL),
+	)
+	if err != nil {
+		return "", err
+	}
+
+	return token, tx.Commit()
+}
+
+func sendPasswordResetEmail(email, token string) error {
+	link := fmt.Sprintf("%s/reset-password?token=%s", getEnv("APP_BASE_URL", "http://localhost:8080"), token)
+	body := fmt.Sprintf("มีการขอตั้งรหัสผ่านใหม่ ลิงก์นี้ใช้ได้ภายใน 30 นาที:\r\n%s\r\n\r\nถ้าคุณไม่ได้เป็นคนขอ ไม่ต้องทำอะไร", link)
+	return mailer.Send(email, "Reset your Bookstore password", body)
+}
+
+// resetPasswordWithToken ใช้ token (ครั้งเดียว), เปลี่ยนรหัสผ่าน และ revoke refresh token ทั้งหมดของ user
+func resetPasswordWithToken(token, newPassword string) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	var userID int
+	err = tx.QueryRow(
+		`UPDATE password_reset_tokens
+		 SET used_at = NOW()
+		 WHERE token_hash = $1 AND used_at IS NULL AND expires_at > NOW()
+		 RETURNING user_id`,
+		hashToken(token),
+	).Scan(&userID)
+	if err != nil {
+		return 0, err
+	}
+
+	// ใช้รหัสเดิมซ้ำ: rollback ทำให้ token ยังใช้ได้อยู่ ผู้ใช้ลองรหัสใหม่ได้
+	if err := checkPasswordReuse(tx, userID, newPassword); err != nil {
+		return 0, err
+	}
+	passwordHash, err := hashPassword(newPassword)
+	if err != nil {
+		return 0, err
+	}
+
+	if _, err := tx.Exec("UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2", passwordHash, userID); err != nil {
+		return 0, err
+	}
+	if err := recordPasswordHistory(tx, userID, passwordHash); err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID); err != nil {
+		return 0, err
+	}
+
+	return userID, tx.Commit()
+}
+
+// ===================== TOTP / MFA =====================
+const (
+	totpPeriod          = 30
+	totpSkew            = 1 // ยอมให้นาฬิกาคลาดเคลื่อนได้ ±1 step
+	mfaIssuer           = "Bookstore"
+	mfaChallengeTTL     = 5 * time.Minute
+	recoveryCodeCount   = 10
+	mfaTokenMaxFailures = 5 // mfa_token หนึ่งตัวใส่ code ผิดได้เท่านี้ก่อนใช้ไม่ได้อีก
+)
+
+var mfaEncryptionKey [32]byte
+
+// ไม่มี default: key ที่ฝังในโค้ดทำให้ทุกคนที่เห็น source ถอด TOTP secret ได้
+func initMFAKey() {
+	key := os.Getenv("MFA_ENCRYPTION_KEY")
+	if key == "" {
+		log.Fatal("MFA_ENCRYPTION_KEY must be set")
+	}
+	mfaEncryptionKey = sha256.Sum256([]byte(key))
+}
+
+type UserMFA struct {
+	Secret       []byte
+	Enabled      bool
+	LastUsedStep int64
+}
+
+func totpCode(secret []byte, counter uint64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+
+	// dynamic truncation ตาม RFC 4226
+	offset := sum[len(sum)-1] & 0x0f
+	value := binary.BigEndian.Uint32(sum[offset:offset+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", value%1000000)
+}
+
+// คืน time step ที่ code ตรง เพื่อเอาไปกันการใช้ code เดิมซ้ำ
+func validateTOTP(secret []byte, code string, now time.Time) (int64, bool) {
+	step := now.Unix() / totpPeriod
+	for i := -totpSkew; i <= totpSkew; i++ {
+		s := step + int64(i)
+		if hmac.Equal([]byte(totpCode(secret, uint64(s))), []byte(code)) {
+			return s, true
+		}
+	}
+	return 0, false
+}
+
+func encryptMFASecret(secret []byte) (string, error) {
+	block, err := aes.NewCipher(mfaEncryptionKey[:])
+	if err != nil {
+		return "", err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, secret, nil)), nil
+}
+
+func decryptMFASecret(encrypted string) ([]byte, error) {
+	data, err := base64.StdEncoding.DecodeString(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	block, err := aes.NewCipher(mfaEncryptionKey[:])
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < gcm.NonceSize() {
+		return nil, fmt.Errorf("invalid mfa secret")
+	}
+	return gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+}
+
+func getUserMFA(userID int) (*UserMFA, error) {
+	var encrypted string
+	var enabledAt sql.NullTime
+	var mfa UserMFA
+	err := db.QueryRow(
+		"SELECT secret_encrypted, enabled_at, last_used_step FROM user_mfa WHERE user_id = $1",
+		userID,
+	).Scan(&encrypted, &enabledAt, &mfa.LastUsedStep)
+	if err != nil {
+		return nil, err
+	}
+
+	mfa.Secret, err = decryptMFASecret(encrypted)
+	if err != nil {
+		return nil, err
+	}
+	mfa.Enabled = enabledAt.Valid
+	return &mfa, nil
+}
+
+// true ถ้ามี role ใดของ user ที่ตั้ง require_mfa ไว้
+func userRequiresMFA(userID int) bool {
+	var required bool
+	err := db.QueryRow(
+		`SELECT EXISTS(
+			SELECT 1 FROM roles r
+			JOIN user_roles ur ON r.id = ur.role_id
+			WHERE ur.user_id = $1 AND r.require_mfa = true
+		)`,
+		userID,
+	).Scan(&required)
+	if err != nil {
+		log.Printf("Error checking mfa requirement: %v", err)
+		return true // ถ้าเช็คไม่ได้ให้ปลอดภัยไว้ก่อน
+	}
+	return required
+}
+
+// ตรวจ TOTP ก่อน ถ้าไม่ตรงค่อยลองเป็น recovery code; คืนวิธีที่ใช้ ("totp" / "recovery_code")
+func verifyMFACode(userID int, mfa *UserMFA, code string) (string, bool) {
+	code = strings.TrimSpace(code)
+
+	if step, ok := validateTOTP(mfa.Secret, code, time.Now()); ok {
+		// update แบบมีเงื่อนไขเพื่อไม่ให้ code เดิมถูกใช้ซ้ำ (แม้จะส่งมาพร้อมกัน)
+		result, err := db.Exec(
+			"UPDATE user_mfa SET last_used_step = $1 WHERE user_id = $2 AND last_used_step < $1",
+			step, userID,
+		)
+		if err != nil {
+			log.Printf("Error updating mfa step: %v", err)
+			return "", false
+		}
+		if rows, _ := result.RowsAffected(); rows > 0 {
+			return "totp", true
+		}
+		return "", false
+	}
+
+	result, err := db.Exec(
+		`UPDATE mfa_recovery_codes SET used_at = NOW()
+		 WHERE user_id = $1 AND code_hash = $2 AND used_at IS NULL`,
+		userID, hashToken(strings.ToLower(code)),
+	)
+	if err != nil {
+		log.Printf("Error using recovery code: %v", err)
+		return "", false
+	}
+	if rows, _ := result.RowsAffected(); rows > 0 {
+		return "recovery_code", true
+	}
+	return "", false
+}
+
+func generateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		h := hex.EncodeToString(b)
+		codes[i] = h[:5] + "-" + h[5:]
+	}
+	return codes, nil
+}
+
+func otpauthURI(username string, secret []byte) string {
+	params := url.Values{}
+	params.Set("secret", base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret))
+	params.Set("issuer", mfaIssuer)
+	params.Set("algorithm", "SHA1")
+	params.Set("digits", "6")
+	params.Set("period", fmt.Sprintf("%d", totpPeriod))
+	return fmt.Sprintf("otpauth://totp/%s?%s", url.PathEscape(mfaIssuer+":"+username), params.Encode())
+}
+
+// token อายุสั้นที่ใช้ได้เฉพาะขั้นตอน MFA (authMiddleware ไม่รับ token ที่มี purpose)
+func generateMFAChallengeToken(userID int, username, purpose string) (string, error) {
+	claims := &CustomClaims{
+		UserID:   userID,
+		Username: username,
+		Roles:    []string{},
+		Purpose:  purpose,
+		RegisteredClaims: jwt.RegisteredClaims{
+			ExpiresAt: jwt.NewNumericDate(time.Now().Add(mfaChallengeTTL)),
+			IssuedAt:  jwt.NewNumericDate(time.Now()),
+			Issuer:    "bookstore-api",
+		},
+	}
+	return signToken(claims)
+}
+
+// ===================== Brute-force Protection =====================
+// นับ login ที่ผิดแยกตาม username และ IP ใน login_attempts (แชร์กันได้หลาย replica)
+// ผิดแต่ละครั้งต้องรอนานขึ้นเป็นเท่าตัว (exponential backoff) และครบ threshold จะถูกล็อคชั่วคราว
+var (
+	loginUserLockoutThreshold = getEnvInt("LOGIN_LOCKOUT_THRESHOLD", 5)
+	loginIPLockoutThreshold   = getEnvInt("LOGIN_IP_LOCKOUT_THRESHOLD", 20)
+	loginLockoutDuration      = getEnvDuration("LOGIN_LOCKOUT_DURATION", 15*time.Minute)
+	loginAttemptWindow        = getEnvDuration("LOGIN_ATTEMPT_WINDOW", 15*time.Minute)
+	loginBackoffBase          = getEnvDuration("LOGIN_BACKOFF_BASE", time.Second)
+	loginBackoffMax           = getEnvDuration("LOGIN_BACKOFF_MAX", 30*time.Second)
+)
+
+type LoginAttempt struct {
+	KeyType      string     `json:"key_type"`
+	KeyValue     string     `json:"key_value"`
+	FailedCount  int        `json:"failed_count"`
+	LastFailedAt time.Time  `json:"last_failed_at"`
+	LockedUntil  *time.Time `json:"locked_until,omitempty"`
+}
+
+type UnlockRequest struct {
+	Username string `json:"username"`
+	IP       string `json:"ip"`
+}
+
+func loginBackoff(failedCount int) time.Duration {
+	if failedCount <= 0 {
+		return 0
+	}
+	if failedCount > 16 {
+		return loginBackoffMax
+	}
+	delay := loginBackoffBase << (failedCount - 1)
+	if delay > loginBackoffMax {
+		return loginBackoffMax
+	}
+	return delay
+}
+
+// คืนเวลาที่ต้องรอก่อน login ได้อีกครั้ง (0 = login ได้เลย)
+func loginRetryAfter(keyType, keyValue string) time.Duration {
+	var failedCount int
+	var sinceLastFailure, lockedFor float64
+	err := db.QueryRow(
+		`SELECT failed_count,
+			EXTRACT(EPOCH FROM NOW() - last_failed_at)::float8,
+			COALESCE(EXTRACT(EPOCH FROM locked_until - NOW()), 0)::float8
+		 FROM login_attempts
+		 WHERE key_type = $1 AND key_value = $2`,
+		keyType, keyValue,
+	).Scan(&failedCount, &sinceLastFailure, &lockedFor)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error checking login attempts: %v", err)
+		}
+		return 0
+	}
+
+	if lockedFor > 0 {
+		return time.Duration(lockedFor * float64(time.Second))
+	}
+	elapsed := time.Duration(sinceLastFailure * float64(time.Second))
+	if elapsed > loginAttemptWindow {
+		return 0
+	}
+	if wait := loginBackoff(failedCount) - elapsed; wait > 0 {
+		return wait
+	}
+	return 0
+}
+
+// นับ login ผิดเพิ่ม 1 ครั้ง (เริ่มนับใหม่ถ้าครั้งก่อนเกิน window) และล็อคถ้าครบ threshold
+func registerLoginFailure(keyType, keyValue string, threshold int) (int, bool) {
+	var failedCount int
+	err := db.QueryRow(
+		`INSERT INTO login_attempts (key_type, key_value, failed_count, first_failed_at, last_failed_at)
+		 VALUES ($1, $2, 1, NOW(), NOW())
+		 ON CONFLICT (key_type, key_value) DO UPDATE SET
+			failed_count = CASE WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $3)
+				THEN 1 ELSE login_attempts.failed_count + 1 END,
+			first_failed_at = CASE WHEN login_attempts.last_failed_at < NOW() - make_interval(secs => $3)
+				THEN NOW() ELSE login_attempts.first_failed_at END,
+			last_failed_at = NOW()
+		 RETURNING failed_count`,
+		keyType, keyValue, loginAttemptWindow.Seconds(),
+	).Scan(&failedCount)
+	if err != nil {
+		log.Printf("Error recording login failure: %v", err)
+		return 0, false
+	}
+
+	if failedCount < threshold {
+		return failedCount, false
+	}
+	_, err = db.Exec(
+		`UPDATE login_attempts SET locked_until = NOW() + make_interval(secs => $3)
+		 WHERE key_type = $1 AND key_value = $2`,
+		keyType, keyValue, loginLockoutDuration.Seconds(),
+	)
+	if err != nil {
+		log.Printf("Error locking login: %v", err)
+	}
+	return failedCount, true
+}
+
+// ผลการจองครั้งที่ของ request นี้ (เก็บใน context ให้ recordFailedLogin/clearLoginFailures ใช้)
+type loginAttemptReservation struct {
+	userCount int
+	ipCount   int
+}
+
+// เช็ค lockout/backoff จากครั้งก่อน แล้ว "จอง" attempt นี้โดยนับเพิ่มทันที (INSERT ... RETURNING failed_count)
+// ก่อนถึง bcrypt: request ที่ยิงมาพร้อมกันจะได้ลำดับคนละค่า ตัวที่เกิน threshold ถูกปฏิเสธทันที
+// ถ้า login สำเร็จจะคืน attempt ที่จองไว้ใน clearLoginFailures
+func checkLoginThrottle(c *gin.Context, username string) bool {
+	ip := c.ClientIP()
+	wait := loginRetryAfter("username", username)
+	if ipWait := loginRetryAfter("ip", ip); ipWait > wait {
+		wait = ipWait
+	}
+	if wait <= 0 {
+		userCount, _ := registerLoginFailure("username", username, loginUserLockoutThreshold)
+		ipCount, _ := registerLoginFailure("ip", ip, loginIPLockoutThreshold)
+		c.Set("login_attempt", loginAttemptReservation{userCount: userCount, ipCount: ipCount})
+		if userCount <= loginUserLockoutThreshold && ipCount <= loginIPLockoutThreshold {
+			return true
+		}
+		wait = loginLockoutDuration
+	}
+
+	seconds := int(math.Ceil(wait.Seconds()))
+	c.Header("Retry-After", strconv.Itoa(seconds))
+	c.JSON(http.StatusTooManyRequests, gin.H{
+		"error":       "too many failed login attempts, please try again later",
+		"retry_after": seconds,
+	})
+	return false
+}
+
+// attempt ถูกนับไปแล้วใน checkLoginThrottle ที่นี่แค่เขียน audit log (userID = 0 ถ้าไม่มี user นี้)
+func recordFailedLogin(c *gin.Context, userID int, username, reason string) {
+	value, _ := c.Get("login_attempt")
+	attempt, _ := value.(loginAttemptReservation)
+
+	logAudit(userID, "login_failed", "auth", nil, gin.H{
+		"username":     username,
+		"reason":       reason,
+		"failed_count": attempt.userCount,
+	}, c)
+
+	// attempt ที่ทำให้ครบ threshold คือตัวที่ล็อค
+	if attempt.userCount == loginUserLockoutThreshold {
+		logAudit(userID, "login_locked", "auth", nil, gin.H{
+			"key_type":        "username",
+			"key_value":       username,
+			"locked_for_secs": int(loginLockoutDuration.Seconds()),
+		}, c)
+	}
+	if attempt.ipCount == loginIPLockoutThreshold {
+		logAudit(userID, "login_locked", "auth", nil, gin.H{
+			"key_type":        "ip",
+			"key_value":       c.ClientIP(),
+			"locked_for_secs": int(loginLockoutDuration.Seconds()),
+		}, c)
+	}
+}
+
+// login สำเร็จล้างตัวนับของ username ส่วนของ IP แค่คืน attempt ที่จองไว้ 1 ครั้ง
+// (ไม่ล้างทั้งหมด ไม่อย่างนั้นคนที่มี account เดียวจะใช้ล้างตัวนับ IP ตัวเองได้)
+func clearLoginFailures(c *gin.Context, username string) {
+	db.Exec("DELETE FROM login_attempts WHERE key_type = 'username' AND key_value = $1", username)
+
+	if _, reserved := c.Get("login_attempt"); reserved {
+		db.Exec(
+			`UPDATE login_attempts
+			 SET failed_count = GREATEST(failed_count - 1, 0),
+				locked_until = CASE WHEN failed_count - 1 < $2 THEN NULL ELSE locked_until END
+			 WHERE key_type = 'ip' AND key_value = $1`,
+			c.ClientIP(), loginIPLockoutThreshold,
+		)
+	}
+}
+
+// ===================== Security Events =====================
+// เหตุการณ์ที่ไม่สำเร็จ/ถูกปฏิเสธ บันทึกลง audit_logs (resource = "security") พร้อม IP และ user agent
+var securityEventActions = []string{
+	"login_failed", "login_locked", "login_disabled_account", "mfa_failed",
+	"token_invalid", "api_key_invalid", "permission_denied",
+}
+
+// token/API key ที่ไม่ถูกต้องยิงมาได้เป็นพันครั้งต่อวินาทีจาก IP เดียว ถ้าบันทึกทุกครั้ง audit_logs จะโดนถมจนเต็ม
+// จึงบันทึกครั้งแรกของแต่ละ (IP, action) ในช่วง SECURITY_EVENT_WINDOW ที่เหลือแค่นับไว้
+// แล้วใส่จำนวนที่ถูกรวบไว้ใน details.suppressed ของครั้งถัดไปที่บันทึก
+var throttledSecurityActions = map[string]bool{"token_invalid": true, "api_key_invalid": true}
+
+const eventThrottleMaxEntries = 10000
+
+type eventThrottleEntry struct {
+	windowStart time.Time
+	suppressed  int
+}
+
+// บันทึกครั้งแรกของแต่ละ key ในแต่ละช่วง window ที่เหลือนับไว้ (ใช้กับ security event และการใช้ API key)
+type eventThrottle struct {
+	mu      sync.Mutex
+	window  time.Duration
+	entries map[string]*eventThrottleEntry
+}
+
+func newEventThrottle(window time.Duration) *eventThrottle {
+	return &eventThrottle{window: window, entries: map[string]*eventThrottleEntry{}}
+}
+
+var securityThrottle = newEventThrottle(getEnvDuration("SECURITY_EVENT_WINDOW", time.Minute))
+
+// คืน true ถ้าควรบันทึก พร้อมจำนวน event ที่ถูกรวบไว้จากช่วงก่อนหน้า
+func (t *eventThrottle) allow(key string, now time.Time) (bool, int) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	entry, ok := t.entries[key]
+	if ok && now.Sub(entry.windowStart) < t.window {
+		entry.suppressed++
+		return false, 0
+	}
+
+	suppressed := 0
+	if ok {
+		suppressed = entry.suppressed
+	}
+	if !ok && len(t.entries) >= eventThrottleMaxEntries {
+		// จำกัด memory: ทิ้ง entry ที่หมดช่วงแล้ว (ยอดที่รวบไว้ของ entry เหล่านั้นจะไม่ถูกบันทึก)
+		for k, e := range t.entries {
+			if now.Sub(e.windowStart) >= t.window {
+				delete(t.entries, k)
+			}
+		}
+	}
+	t.entries[key] = &eventThrottleEntry{windowStart: now}
+	return true, suppressed
+}
+
+func logSecurityEvent(c *gin.Context, userID int, action string, details gin.H) {
+	if details == nil {
+		details = gin.H{}
+	}
+	if throttledSecurityActions[action] {
+		allowed, suppressed := securityThrottle.allow(c.ClientIP()+"|"+action, time.Now())
+		if !allowed {
+			return
+		}
+		if suppressed > 0 {
+			details["suppressed"] = suppressed
+		}
+	}
+	details["method"] = c.Request.Method
+	details["path"] = c.Request.URL.Path
+	logAudit(userID, action, "security", nil, details, c)
+}
+
+// สรุปเหตุการณ์น่าสงสัยย้อนหลัง (?since=24h) แยกตาม IP และตาม account
+func securitySummary(c *gin.Context) {
+	since, err := time.ParseDuration(c.DefaultQuery("since", "24h"))
+	if err != nil || since <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid since, expected a duration such as 24h"})
+		return
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+	from := time.Now().UTC().Add(-since)
+
+	// failed login ด้วย username ที่ไม่มีอยู่จริง user_id เป็น NULL จึงใช้ username จาก details แทน
+	const counts = `
+		COUNT(*),
+		COUNT(*) FILTER (WHERE a.action IN ('login_failed', 'login_locked', 'mfa_failed')),
+		COUNT(*) FILTER (WHERE a.action = 'login_disabled_account'),
+	`
+	const source = `
+		FROM audit_logs a
+		LEFT JOIN users u ON u.id = a.user_id
+		WHERE a.action = ANY($1) AND a.created_at >= $2
+	`
+
+	ipRows, err := db.Query(`
+		SELECT COALESCE(a.ip_address, ''),`+counts+`
+		       COALESCE(SUM(1 + COALESCE((a.details->>'suppressed')::int, 0))
+		                FILTER (WHERE a.action IN ('token_invalid', 'api_key_invalid')), 0),
+		       COUNT(*) FILTER (WHERE a.action = 'permission_denied'),
+		       COUNT(DISTINCT COALESCE(u.username, a.details->>'username')),
+		       MAX(a.created_at)
+	`+source+`
+		GROUP BY a.ip_address
+		ORDER BY COUNT(*) DESC
+		LIMIT $3
+	`, pq.Array(securityEventActions), from, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer ipRows.Close()
+
+	byIP := []SecuritySummaryIP{}
+	for ipRows.Next() {
+		var row SecuritySummaryIP
+		if err := ipRows.Scan(&row.IPAddress, &row.Total, &row.FailedLogins, &row.DisabledAccount,
+			&row.InvalidTokens, &row.PermissionDenied, &row.Accounts, &row.LastSeen); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		byIP = append(byIP, row)
+	}
+
+	accountRows, err := db.Query(`
+		SELECT MAX(a.user_id), COALESCE(u.username, a.details->>'username') AS account,`+counts+`
+		       COUNT(*) FILTER (WHERE a.action = 'permission_denied'),
+		       COUNT(DISTINCT a.ip_address),
+		       MAX(a.created_at)
+	`+source+`
+		  AND COALESCE(u.username, a.details->>'username') IS NOT NULL
+		GROUP BY account
+		ORDER BY COUNT(*) DESC
+		LIMIT $3
+	`, pq.Array(securityEventActions), from, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer accountRows.Close()
+
+	byAccount := []SecuritySummaryAccount{}
+	for accountRows.Next() {
+		var row SecuritySummaryAccount
+		var userID sql.NullInt64
+		if err := accountRows.Scan(&userID, &row.Username, &row.Total, &row.FailedLogins, &row.DisabledAccount,
+			&row.PermissionDenied, &row.IPAddresses, &row.LastSeen); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			row.UserID = &id
+		}
+		byAccount = append(byAccount, row)
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"since":      from,
+		"by_ip":      byIP,
+		"by_account": byAccount,
+	})
+}
+
+// proxy ที่เชื่อ X-Forwarded-For ได้ (comma-separated IP/CIDR) ไม่ตั้ง = ใช้ IP ของ connection ตรงๆ
+func trustedProxies() []string {
+	return getEnvList("TRUSTED_PROXIES", "")
+}
+
+// ไม่ตั้ง CORS_ALLOWED_ORIGINS = อนุญาตทุก origin แบบเดิม (cors.Default) โดยไม่ส่ง credentials
+// ตั้งแล้ว = อนุญาตเฉพาะ origin ที่ระบุและเปิด credentials (ใช้กับ "*" ไม่ได้)
+func corsConfig() cors.Config {
+	config := cors.DefaultConfig()
+	if origins := getEnvList("CORS_ALLOWED_ORIGINS", ""); len(origins) > 0 {
+		config.AllowOrigins = origins
+		config.AllowCredentials = true
+	} else {
+		config.AllowAllOrigins = true
+	}
+	config.AllowHeaders = append(config.AllowHeaders, "Authorization", "X-API-Key")
+	config.ExposeHeaders = []string{"Retry-After"}
+	return config
+}
+
+// ===================== Lockout Admin Endpoints =====================
+func listLockouts(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT key_type, key_value, failed_count, last_failed_at, locked_until
+		FROM login_attempts
+		WHERE locked_until > NOW()
+		ORDER BY locked_until DESC
+	`)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	attempts := []LoginAttempt{}
+	for rows.Next() {
+		var a LoginAttempt
+		var lockedUntil sql.NullTime
+		if err := rows.Scan(&a.KeyType, &a.KeyValue, &a.FailedCount, &a.LastFailedAt, &lockedUntil); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if lockedUntil.Valid {
+			a.LockedUntil = &lockedUntil.Time
+		}
+		attempts = append(attempts, a)
+	}
+
+	c.JSON(http.StatusOK, attempts)
+}
+
+func unlockLogin(c *gin.Context) {
+	var req UnlockRequest
+	if err := c.ShouldBindJSON(&req); err != nil || (req.Username == "" && req.IP == "") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "username or ip required"})
+		return
+	}
+
+	result, err := db.Exec(
+		`DELETE FROM login_attempts
+		 WHERE (key_type = 'username' AND key_value = $1)
+		    OR (key_type = 'ip' AND key_value = $2)`,
+		req.Username, req.IP,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	cleared, _ := result.RowsAffected()
+
+	logAudit(c.GetInt("user_id"), "login_unlock", "auth", nil, gin.H{
+		"username": req.Username,
+		"ip":       req.IP,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "login unlocked", "cleared": cleared})
+}
+
+func initDB() {
+	var err error
+
+	host := getEnv("DB_HOST", "")
+	name := getEnv("DB_NAME", "")
+	user := getEnv("DB_USER", "")
+	password := getEnv("DB_PASSWORD", "")
+	port := getEnv("DB_PORT", "")
+
+	conSt := fmt.Sprintf("host=%s port=%s user=%s password=%s dbname=%s sslmode=disable", host, port, user, password, name)
+	dbConnString = conSt // ใช้ต่อกับ LISTEN/NOTIFY
+	// fmt.Println(conSt)
+	db, err = sql.Open("postgres", conSt)
+	if err != nil {
+		log.Fatal("failed to open database")
+	}
+
+	// กำหนดจำนวน Connection สูงสุด
+	db.SetMaxOpenConns(25)
+
+	// กำหนดจำนวน Idle connection สูงสุด
+	db.SetMaxIdleConns(25)
+
+	// กำหนดอายุของ Connection
+	db.SetConnMaxLifetime(5 * time.Minute)
+
+	err = db.Ping()
+	if err != nil {
+		log.Fatal("failed to connect to database", err)
+	}
+	log.Println("successfully connected to database")
+}
+
+// ===================== Authentication Endpoints =====================
+func login(c *gin.Context) {
+	var req LoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// เช็ค lockout ก่อน query/bcrypt เพื่อไม่ให้ถูกใช้เผา CPU
+	if !checkLoginThrottle(c, req.Username) {
+		return
+	}
+
+	// ดึงข้อมูล user จาก database
+	var user User
+	query := `
+		SELECT id, username, email, password_hash, is_active, email_verified
+		FROM users
+		WHERE username = $1
+	`
+
+	err := db.QueryRow(query, req.Username).Scan(
+		&user.ID,
+		&user.Username,
+		&user.Email,
+		&user.PasswordHash,
+		&user.IsActive,
+		&user.EmailVerified,
+	)
+
+	if err == sql.ErrNoRows {
+		recordFailedLogin(c, 0, req.Username, "unknown_user")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return
+	} else if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// ตรวจสอบว่า user active หรือไม่
+	if !user.IsActive {
+		logSecurityEvent(c, user.ID, "login_disabled_account", gin.H{"username": user.Username})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "account is disabled"})
+		return
+	}
+
+	// ตรวจสอบ password
+	if err := verifyPassword(user.PasswordHash, req.Password); err != nil {
+		recordFailedLogin(c, user.ID, req.Username, "invalid_password")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		return
+	}
+	clearLoginFailures(c, req.Username)
+	rehashPassword(c, &user, req.Password)
+
+	// ต้องยืนยันอีเมลก่อนถึงจะ login ได้ (เช็คหลัง password เพื่อไม่ให้รู้ว่ามี account นี้)
+	if !user.EmailVerified {
+		c.JSON(http.StatusForbidden, gin.H{"error": "email not verified"})
+		return
+	}
+
+	// ถ้าเปิด MFA ไว้ ต้องผ่านขั้นที่สอง (/auth/login/mfa) ก่อนถึงจะได้ tokens
+	mfa, err := getUserMFA(user.ID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading mfa: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if mfa != nil && mfa.Enabled {
+		mfaToken, err := generateMFAChallengeToken(user.ID, user.Username, "mfa_login")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate mfa token"})
+			return
+		}
+		c.JSON(http.StatusOK, gin.H{
+			"mfa_required": true,
+			"mfa_token":    mfaToken,
+			"expires_in":   int(mfaChallengeTTL.Seconds()),
+		})
+		return
+	}
+
+	// role บังคับ MFA แต่ยังไม่ได้ลงทะเบียน ให้ token สำหรับลงทะเบียนอย่างเดียว
+	if userRequiresMFA(user.ID) {
+		mfaToken, err := generateMFAChallengeToken(user.ID, user.Username, "mfa_enroll")
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate mfa token"})
+			return
+		}
+		c.JSON(http.StatusForbidden, gin.H{
+			"error":     "mfa enrollment required",
+			"mfa_token": mfaToken,
+		})
+		return
+	}
+
+	issueLoginTokens(c, &user, nil)
+}
+
+// สร้าง access/refresh token หลังยืนยันตัวตนครบแล้ว (password และ MFA ถ้ามี)
+func issueLoginTokens(c *gin.Context, user *User, auditDetails gin.H) {
+	// ดึง roles ของ user
+	roles, err := getUserRoles(user.ID)
+	if err != nil {
+		log.Printf("Error getting roles: %v", err)
+		roles = []string{} // ถ้าดึงไม่ได้ให้เป็น empty array
+	}
+
+	// สร้าง tokens
+	accessToken, err := generateAccessToken(user.ID, user.Username, roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+
+	refreshToken, err := generateRefreshToken(user.ID, user.Username)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
+		return
+	}
+
+	// บันทึก refresh token ในฐานข้อมูล
+	expiresAt := time.Now().Add(7 * 24 * time.Hour)
+	if err := storeRefreshToken(user.ID, refreshToken, expiresAt, c); err != nil {
+		log.Printf("Error storing refresh token: %v", err)
+		// ไม่ return error เพราะ token ยังใช้ได้
+	}
+
+	// อัพเดท last_login
+	db.Exec("UPDATE users SET last_login = NOW() WHERE id = $1", user.ID)
+
+	// Log audit
+	if auditDetails == nil {
+		auditDetails = gin.H{}
+	}
+	auditDetails["username"] = user.Username
+	logAudit(user.ID, "login", "auth", nil, auditDetails, c)
+
+	// ส่ง response
+	c.JSON(http.StatusOK, LoginResponse{
+		AccessToken:  accessToken,
+		RefreshToken: refreshToken,
+		User: UserInfo{
+			ID:       user.ID,
+			Username: user.Username,
+			Email:    user.Email,
+			Roles:    roles,
+		},
+	})
+}
+
+func refreshTokenHandler(c *gin.Context) {
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// ตรวจสอบ refresh token
+	userID, valid := isRefreshTokenValid(req.RefreshToken)
+	if !valid {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+		return
+	}
+
+	// ดึงข้อมูล user
+	var username string
+	err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		return
+	}
+
+	// ดึง roles
+	roles, err := getUserRoles(userID)
+	if err != nil {
+		roles = []string{}
+	}
+
+	// สร้าง access token ใหม่
+	accessToken, err := generateAccessToken(userID, username, roles)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"access_token": accessToken,
+	})
+}
+
+func logout(c *gin.Context) {
+	// ดึง refresh token จาก request
+	var req RefreshRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// Revoke refresh token
+	if err := revokeRefreshToken(req.RefreshToken); err != nil {
+		log.Printf("Error revoking token: %v", err)
+	}
+
+	// Log audit (ถ้ามี user_id ใน context)
+	if userID, exists := c.Get("user_id"); exists {
+		logAudit(userID.(int), "logout", "auth", nil, nil, c)
+	}
+
+	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
+}
+
+// ===================== Session Endpoints =====================
+// ใช้ได้ทั้ง /auth/sessions (ของตัวเอง) และ /api/v1/users/:id/sessions (admin จัดการของคนอื่น)
+func sessionOwnerID(c *gin.Context) (int, bool) {
+	if c.Param("id") != "" {
+		return userIDParam(c)
+	}
+	return c.GetInt("user_id"), true
+}
+
+func listSessions(c *gin.Context) {
+	userID, ok := sessionOwnerID(c)
+	if !ok {
+		return
+	}
+
+	rows, err := db.Query(`
+		SELECT id, COALESCE(user_agent, ''), COALESCE(ip_address, ''), created_at, last_used_at, expires_at
+		FROM refresh_tokens
+		WHERE user_id = $1 AND revoked_at IS NULL AND expires_at > NOW()
+		ORDER BY COALESCE(last_used_at, created_at) DESC
+	`, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	sessions := []Session{}
+	for rows.Next() {
+		var session Session
+		var lastUsedAt sql.NullTime
+		if err := rows.Scan(&session.ID, &session.UserAgent, &session.IPAddress, &session.CreatedAt, &lastUsedAt, &session.ExpiresAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if lastUsedAt.Valid {
+			session.LastUsedAt = &lastUsedAt.Time
+		}
+		sessions = append(sessions, session)
+	}
+
+	c.JSON(http.StatusOK, sessions)
+}
+
+func revokeSession(c *gin.Context) {
+	userID, ok := sessionOwnerID(c)
+	if !ok {
+		return
+	}
+	sessionID := c.Param("session_id")
+
+	// เงื่อนไข user_id ทำให้ revoke session ของคนอื่นผ่าน /auth/sessions ไม่ได้
+	result, err := db.Exec(
+		"UPDATE refresh_tokens SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		sessionID, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "session not found"})
+		return
+	}
+
+	logAudit(c.GetInt("user_id"), "revoke_session", "sessions", sessionID, gin.H{
+		"target_user_id": userID,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "session revoked"})
+}
+
+func logoutAll(c *gin.Context) {
+	userID, ok := sessionOwnerID(c)
+	if !ok {
+		return
+	}
+
+	result, err := db.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revoked, _ := result.RowsAffected()
+
+	logAudit(c.GetInt("user_id"), "logout_all", "sessions", nil, gin.H{
+		"target_user_id":   userID,
+		"sessions_revoked": revoked,
+	}, c)
+
+	// access token ที่ออกไปแล้วยังใช้ได้จนหมดอายุ (15 นาที)
+	c.JSON(http.StatusOK, gin.H{"message": "all sessions revoked", "sessions_revoked": revoked})
+}
+
+// ===================== API Key Endpoints =====================
+// key รูปแบบ pat_<hex> แสดงให้ผู้ใช้เห็นครั้งเดียวตอนสร้าง ในฐานข้อมูลเก็บแค่ hash
+const apiKeyPrefix = "pat_"
+
+func createAPIKey(c *gin.Context) {
+	// ไม่ให้ key สร้าง key ใหม่ (จะกลายเป็นต่ออายุตัวเองได้เรื่อยๆ)
+	if _, ok := c.Get("api_key_id"); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot create API keys"})
+		return
+	}
+
+	var req CreateAPIKeyRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	// scope ต้องเป็นส่วนหนึ่งของสิทธิ์ที่เจ้าของมีอยู่
+	userID := c.GetInt("user_id")
+	permissions := requestPermissions(c, userID)
+	for _, scope := range req.Scopes {
+		if resource, action := splitPermission(scope); resource == "" || action == "" {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid scope", "scope": scope})
+			return
+		}
+		if !permissionGranted(permissions, scope) {
+			c.JSON(http.StatusForbidden, gin.H{"error": "scope exceeds your permissions", "scope": scope})
+			return
+		}
+	}
+
+	secret, err := generateOneTimeToken()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal error"})
+		return
+	}
+	key := apiKeyPrefix + secret
+
+	apiKey := APIKey{Name: req.Name, Prefix: key[:len(apiKeyPrefix)+8], Scopes: req.Scopes}
+	if req.ExpiresInDays > 0 {
+		expiresAt := time.Now().AddDate(0, 0, req.ExpiresInDays)
+		apiKey.ExpiresAt = &expiresAt
+	}
+
+	err = db.QueryRow(`
+		INSERT INTO api_keys (user_id, name, key_prefix, key_hash, scopes, expires_at)
+		VALUES ($1, $2, $3, $4, $5, $6)
+		RETURNING id, created_at
+	`, userID, apiKey.Name, apiKey.Prefix, hashToken(key), pq.Array(apiKey.Scopes), apiKey.ExpiresAt).Scan(&apiKey.ID, &apiKey.CreatedAt)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAudit(userID, "create_api_key", "api_keys", apiKey.ID, gin.H{
+		"name":   apiKey.Name,
+		"scopes": apiKey.Scopes,
+	}, c)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"api_key": apiKey,
+		"key":     key, // แสดงครั้งเดียว
+	})
+}
+
+func listAPIKeys(c *gin.Context) {
+	rows, err := db.Query(`
+		SELECT id, name, key_prefix, scopes, expires_at, last_used_at, created_at
+		FROM api_keys
+		WHERE user_id = $1 AND revoked_at IS NULL
+		ORDER BY created_at DESC
+	`, c.GetInt("user_id"))
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	keys := []APIKey{}
+	for rows.Next() {
+		var key APIKey
+		var expiresAt, lastUsedAt sql.NullTime
+		if err := rows.Scan(&key.ID, &key.Name, &key.Prefix, pq.Array(&key.Scopes), &expiresAt, &lastUsedAt, &key.CreatedAt); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if expiresAt.Valid {
+			key.ExpiresAt = &expiresAt.Time
+		}
+		if lastUsedAt.Valid {
+			key.LastUsedAt = &lastUsedAt.Time
+		}
+		keys = append(keys, key)
+	}
+
+	c.JSON(http.StatusOK, keys)
+}
+
+func revokeAPIKey(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	keyID := c.Param("key_id")
+
+	result, err := db.Exec(
+		"UPDATE api_keys SET revoked_at = NOW() WHERE id = $1 AND user_id = $2 AND revoked_at IS NULL",
+		keyID, userID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "api key not found"})
+		return
+	}
+
+	logAudit(userID, "revoke_api_key", "api_keys", keyID, nil, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "api key revoked"})
+}
+
+// ===================== MFA Endpoints =====================
+// ขั้นที่สองของ login: แลก mfa_token + code เป็น access/refresh token
+func loginMFA(c *gin.Context) {
+	var req MFALoginRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	claims, err := verifyToken(req.MFAToken)
+	if err != nil || claims.Purpose != "mfa_login" {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	var user User
+	err = db.QueryRow(
+		"SELECT id, username, email, is_active FROM users WHERE id = $1",
+		claims.UserID,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive)
+	if err != nil || !user.IsActive {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	mfa, err := getUserMFA(user.ID)
+	if err != nil || !mfa.Enabled {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired mfa token"})
+		return
+	}
+
+	// code มี 6 หลัก ต้องจำกัดการเดา: backoff/lockout ต่อ username และ IP เหมือน login
+	// และ mfa_token แต่ละตัวผิดได้ไม่เกิน mfaTokenMaxFailures ครั้ง (ต้อง login ด้วยรหัสผ่านใหม่)
+	tokenKey := hashToken(req.MFAToken)
+	if mfaTokenExhausted(tokenKey) {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "too many invalid codes, please log in again"})
+		return
+	}
+	if !checkLoginThrottle(c, user.Username) {
+		return
+	}
+
+	method, ok := verifyMFACode(user.ID, mfa, req.Code)
+	if !ok {
+		registerLoginFailure("mfa_token", tokenKey, mfaTokenMaxFailures)
+		recordFailedLogin(c, user.ID, user.Username, "invalid_mfa_code")
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid mfa code"})
+		return
+	}
+	clearLoginFailures(c, user.Username)
+
+	issueLoginTokens(c, &user, gin.H{"mfa_method": method})
+}
+
+// mfa_token ที่ใส่ code ผิดครบจำนวนจะถูกล็อคนานกว่าอายุ token จึงเท่ากับใช้ไม่ได้อีก
+func mfaTokenExhausted(tokenKey string) bool {
+	var locked bool
+	err := db.QueryRow(
+		"SELECT locked_until > NOW() FROM login_attempts WHERE key_type = 'mfa_token' AND key_value = $1",
+		tokenKey,
+	).Scan(&locked)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error checking mfa token attempts: %v", err)
+		return true
+	}
+	return locked
+}
+
+func mfaEnroll(c *gin.Context) {
+	userID := c.GetInt("user_id")
+	username := c.GetString("username")
+
+	existing, err := getUserMFA(userID)
+	if err != nil && err != sql.ErrNoRows {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if existing != nil && existing.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa already enabled"})
+		return
+	}
+
+	secret := make([]byte, 20) // 160 bits ตามที่ RFC 4226 แนะนำ
+	if _, err := rand.Read(secret); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	encrypted, err := encryptMFASecret(secret)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// ลงทะเบียนซ้ำได้จนกว่าจะ confirm (secret ใหม่แทนของเดิม)
+	_, err = db.Exec(
+		`INSERT INTO user_mfa (user_id, secret_encrypted)
+		 VALUES ($1, $2)
+		 ON CONFLICT (user_id) DO UPDATE
+		 SET secret_encrypted = EXCLUDED.secret_encrypted, enabled_at = NULL, last_used_step = 0, created_at = NOW()`,
+		userID, encrypted,
+	)
+	if err != nil {
+		log.Printf("Error storing mfa secret: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	c.JSON(http.StatusOK, gin.H{
+		"secret":      base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(secret),
+		"otpauth_uri": otpauthURI(username, secret),
+	})
+}
+
+func mfaConfirm(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	userID := c.GetInt("user_id")
+
+	mfa, err := getUserMFA(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mfa enrollment not started"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if mfa.Enabled {
+		c.JSON(http.StatusConflict, gin.H{"error": "mfa already enabled"})
+		return
+	}
+
+	step, ok := validateTOTP(mfa.Secret, strings.TrimSpace(req.Code), time.Now())
+	if !ok {
+		logSecurityEvent(c, userID, "mfa_failed", gin.H{"stage": "confirm"})
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid mfa code"})
+		return
+	}
+
+	codes, err := generateRecoveryCodes()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("UPDATE user_mfa SET enabled_at = NOW(), last_used_step = $1 WHERE user_id = $2", step, userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	for _, code := range codes {
+		if _, err := tx.Exec("INSERT INTO mfa_recovery_codes (user_id, code_hash) VALUES ($1, $2)", userID, hashToken(code)); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	logAudit(userID, "mfa_enabled", "auth", userID, nil, c)
+
+	// recovery codes แสดงแค่ครั้งนี้ครั้งเดียว
+	c.JSON(http.StatusOK, gin.H{
+		"message":        "mfa enabled, please log in again",
+		"recovery_codes": codes,
+	})
+}
+
+func mfaDisable(c *gin.Context) {
+	var req MFACodeRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	userID := c.GetInt("user_id")
+
+	if userRequiresMFA(userID) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "mfa is required by your role"})
+		return
+	}
+
+	mfa, err := getUserMFA(userID)
+	if err != nil && err != sql.ErrNoRows {
+		log.Printf("Error loading mfa: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if mfa == nil || !mfa.Enabled {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "mfa is not enabled"})
+		return
+	}
+	if _, ok := verifyMFACode(userID, mfa, req.Code); !ok {
+		logSecurityEvent(c, userID, "mfa_failed", gin.H{"stage": "disable"})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid mfa code"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec("DELETE FROM mfa_recovery_codes WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if _, err := tx.Exec("DELETE FROM user_mfa WHERE user_id = $1", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	logAudit(userID, "mfa_disabled", "auth", userID, nil, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "mfa disabled"})
+}
+
+func setRoleMFARequirement(c *gin.Context) {
+	var req RoleMFARequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	id, ok := roleIDParam(c)
+	if !ok {
+		return
+	}
+
+	var roleName string
+	err := db.QueryRow(
+		"UPDATE roles SET require_mfa = $1, updated_at = NOW() WHERE id = $2 RETURNING name",
+		*req.RequireMFA, id,
+	).Scan(&roleName)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAudit(c.GetInt("user_id"), "update_mfa_requirement", "roles", id, gin.H{
+		"role":        roleName,
+		"require_mfa": *req.RequireMFA,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"role": roleName, "require_mfa": *req.RequireMFA})
+}
+
+// ===================== Registration Endpoints =====================
+func register(c *gin.Context) {
+	var req RegisterRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	// ตรวจสอบว่า username / email ซ้ำหรือไม่
+	var usernameTaken, emailTaken bool
+	err := db.QueryRow(
+		`SELECT
+			EXISTS(SELECT 1 FROM users WHERE username = $1),
+			EXISTS(SELECT 1 FROM users WHERE LOWER(email) = $2)`,
+		req.Username, req.Email,
+	).Scan(&usernameTaken, &emailTaken)
+	if err != nil {
+		log.Printf("Database error: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	if usernameTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "username already taken"})
+		return
+	}
+	if emailTaken {
+		c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
+		return
+	}
+
+	if err := validatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	// สร้าง user + role + verification token ใน transaction เดียว
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	var user User
+	err = tx.QueryRow(
+		`INSERT INTO users (username, email, password_hash)
+		 VALUES ($1, $2, $3)
+		 RETURNING id, username, email, is_active, email_verified, created_at`,
+		req.Username, req.Email, passwordHash,
+	).Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.EmailVerified, &user.CreatedAt)
+	if err != nil {
+		// ชน unique constraint ระหว่างที่มีคนสมัครพร้อมกัน
+		log.Printf("Error creating user: %v", err)
+		c.JSON(http.StatusConflict, gin.H{"error": "username or email already registered"})
+		return
+	}
+	if err := recordPasswordHistory(tx, user.ID, passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// ให้ role เริ่มต้น "user"
+	_, err = tx.Exec(
+		`INSERT INTO user_roles (user_id, role_id)
+		 SELECT $1, id FROM roles WHERE name = 'user'`,
+		user.ID,
+	)
+	if err != nil {
+		log.Printf("Error assigning default role: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	token, err := createEmailVerificationToken(tx, user.ID)
+	if err != nil {
+		log.Printf("Error creating verification token: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	// ส่งอีเมลไม่สำเร็จไม่ต้อง fail เพราะขอ resend ได้
+	if err := sendVerificationEmail(user.Email, token); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	logAudit(user.ID, "register", "auth", user.ID, gin.H{
+		"username": user.Username,
+	}, c)
+
+	c.JSON(http.StatusCreated, gin.H{
+		"message": "registration successful, please verify your email",
+		"user":    user,
+	})
+}
+
+func verifyEmail(c *gin.Context) {
+	token := c.Query("token")
+	if token == "" {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "missing token"})
+		return
+	}
+
+	userID, err := consumeEmailVerificationToken(token)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	} else if err != nil {
+		log.Printf("Error verifying email: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	logAudit(userID, "verify_email", "auth", userID, nil, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "email verified successfully"})
+}
+
+func resendVerification(c *gin.Context) {
+	var req ResendVerificationRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// ตอบเหมือนกันทุกกรณี เพื่อไม่ให้เดาได้ว่าอีเมลไหนมีในระบบ
+	response := gin.H{"message": "if the account exists and is not verified, a new email has been sent"}
+
+	var userID int
+	err := db.QueryRow(
+		"SELECT id FROM users WHERE LOWER(email) = $1 AND email_verified = false AND is_active = true",
+		strings.ToLower(strings.TrimSpace(req.Email)),
+	).Scan(&userID)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Database error: %v", err)
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	defer tx.Rollback()
+
+	// token เก่าที่ยังไม่ใช้ให้หมดอายุไปเลย
+	if _, err := tx.Exec("UPDATE email_verification_tokens SET used_at = NOW() WHERE user_id = $1 AND used_at IS NULL", userID); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+	token, err := createEmailVerificationToken(tx, userID)
+	if err != nil || tx.Commit() != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	if err := sendVerificationEmail(req.Email, token); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	c.JSON(http.StatusOK, response)
+}
+
+// ===================== Password Reset Endpoints =====================
+func forgotPassword(c *gin.Context) {
+	var req ForgotPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+
+	// ตอบเหมือนกันทุกกรณี ไม่บอกว่าอีเมลนี้มีในระบบหรือไม่
+	response := gin.H{"message": "if the email is registered, a reset link has been sent"}
+
+	var userID int
+	var email string
+	err := db.QueryRow(
+		"SELECT id, email FROM users WHERE LOWER(email) = $1 AND is_active = true",
+		strings.ToLower(strings.TrimSpace(req.Email)),
+	).Scan(&userID, &email)
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Database error: %v", err)
+		}
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	token, err := createPasswordResetToken(userID)
+	if err != nil {
+		log.Printf("Error creating reset token: %v", err)
+		c.JSON(http.StatusOK, response)
+		return
+	}
+
+	if err := sendPasswordResetEmail(email, token); err != nil {
+		log.Printf("Error sending reset email: %v", err)
+	}
+
+	logAudit(userID, "password_reset_request", "auth", userID, nil, c)
+
+	c.JSON(http.StatusOK, response)
+}
+
+func resetPassword(c *gin.Context) {
+	var req ResetPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := validatePassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	userID, err := resetPasswordWithToken(req.Token, req.NewPassword)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid or expired token"})
+		return
+	} else if err == errPasswordReused {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		log.Printf("Error resetting password: %v", err)
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		return
+	}
+
+	logAudit(userID, "password_reset", "auth", userID, gin.H{
+		"refresh_tokens_revoked": true,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "password has been reset, please log in again"})
+}
+
+// ===================== Middleware =====================
+func authMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		// API key ส่งมาทาง X-API-Key หรือ Authorization: Bearer pat_...
+		if apiKey := c.GetHeader("X-API-Key"); apiKey != "" {
+			authenticateAPIKey(c, apiKey)
+			return
+		}
+
+		// ดึง token จาก Authorization header
+		authHeader := c.GetHeader("Authorization")
+		if authHeader == "" {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header required"})
+			c.Abort()
+			return
+		}
+
+		// ตรวจสอบ format: "Bearer <token>"
+		parts := strings.Split(authHeader, " ")
+		if len(parts) != 2 || parts[0] != "Bearer" {
+			logSecurityEvent(c, 0, "token_invalid", gin.H{"reason": "malformed_header"})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header format"})
+			c.Abort()
+			return
+		}
+
+		tokenString := parts[1]
+		if strings.HasPrefix(tokenString, apiKeyPrefix) {
+			authenticateAPIKey(c, tokenString)
+			return
+		}
+
+		// Verify token (MFA challenge token ใช้เรียก API ไม่ได้)
+		claims, err := verifyToken(tokenString)
+		if err != nil || claims.Purpose != "" {
+			reason := "invalid"
+			if errors.Is(err, jwt.ErrTokenExpired) {
+				reason = "expired"
+			} else if err == nil {
+				reason = "wrong_purpose"
+			}
+			logSecurityEvent(c, 0, "token_invalid", gin.H{"reason": reason})
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+			c.Abort()
+			return
+		}
+
+		// impersonation token ใช้ได้เฉพาะตอนที่ผู้ใช้จริงยังมีสิทธิ์ users:impersonate อยู่
+		if claims.Act != nil {
+			actorPermissions, err := getUserPermissions(claims.Act.UserID)
+			if err != nil || !permissionGranted(actorPermissions, "users:impersonate") {
+				logSecurityEvent(c, claims.Act.UserID, "token_invalid", gin.H{"reason": "impersonation_revoked"})
+				c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+				c.Abort()
+				return
+			}
+			c.Set("actor_id", claims.Act.UserID)
+			c.Set("actor_username", claims.Act.Username)
+		}
+
+		// เก็บข้อมูล user ใน context (ตอน impersonate = user ที่ถูกสวมรอย)
+		c.Set("user_id", claims.UserID)
+		c.Set("username", claims.Username)
+		c.Set("roles", claims.Roles)
+
+		c.Next()
+	}
+}
+
+// กันไม่ให้ใช้ impersonation token ทำเรื่องที่มีผลกับ credential ของเจ้าของบัญชี
+func denyImpersonation() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("actor_id"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not allowed while impersonating"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// สิทธิ์ของ API key = สิทธิ์ปัจจุบันของเจ้าของ ∩ scopes ของ key (ตรวจใน hasPermission)
+func authenticateAPIKey(c *gin.Context, key string) {
+	var keyID, userID int
+	var username string
+	var scopes []string
+	err := db.QueryRow(`
+		UPDATE api_keys k
+		SET last_used_at = NOW()
+		FROM users u
+		WHERE k.key_hash = $1 AND k.user_id = u.id
+		  AND k.revoked_at IS NULL
+		  AND (k.expires_at IS NULL OR k.expires_at > NOW())
+		  AND u.is_active = true
+		RETURNING k.id, u.id, u.username, k.scopes
+	`, hashToken(key)).Scan(&keyID, &userID, &username, pq.Array(&scopes))
+	if err != nil {
+		if err != sql.ErrNoRows {
+			log.Printf("Error checking api key: %v", err)
+		}
+		logSecurityEvent(c, 0, "api_key_invalid", gin.H{"key_prefix": key[:min(len(key), len(apiKeyPrefix)+8)]})
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired api key"})
+		c.Abort()
+		return
+	}
+
+	scopeGrants := make(map[string]bool, len(scopes))
+	for _, scope := range scopes {
+		scopeGrants[scope] = true
+	}
+	roles, _ := getUserRoles(userID)
+
+	c.Set("user_id", userID)
+	c.Set("username", username)
+	c.Set("roles", roles)
+	c.Set("api_key_id", keyID)
+	c.Set("api_key_scopes", scopeGrants)
+
+	// เขียน audit ทุก request ที่ใช้ key ปริมาณจะเท่ากับ traffic ทั้งหมด จึงบันทึก use_api_key แถวเดียวต่อ key
+	// ต่อ API_KEY_USAGE_WINDOW โดย uses_since_last_entry = จำนวนครั้งที่ใช้ key ระหว่างแถวก่อนหน้ากับแถวนี้
+	if allowed, uses := apiKeyUsageThrottle.allow(strconv.Itoa(keyID), time.Now()); allowed {
+		logAudit(userID, "use_api_key", "api_keys", keyID, gin.H{
+			"uses_since_last_entry": uses,
+			"method":                c.Request.Method,
+			"path":                  c.Request.URL.Path,
+		}, c)
+	}
+}
+
+var apiKeyUsageThrottle = newEventThrottle(getEnvDuration("API_KEY_USAGE_WINDOW", time.Hour))
+
+// endpoint self-service ใน /auth (sessions, api keys, MFA) เป็นของเจ้าของบัญชีเท่านั้น
+// scope ของ key ตรวจแค่ใน requirePermission จึงต้องกัน key ออกจากกลุ่มนี้ตรงๆ
+func denyAPIKey() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, ok := c.Get("api_key_id"); ok {
+			c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot be used for this endpoint"})
+			c.Abort()
+			return
+		}
+		c.Next()
+	}
+}
+
+// ใช้กับการลงทะเบียน MFA: รับได้ทั้ง access token ปกติ และ mfa_enroll token
+// (กรณีที่ role บังคับ MFA แต่ user ยังไม่เคยลงทะเบียน จึงยังไม่มี access token)
+func mfaEnrollmentMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		tokenString := strings.TrimPrefix(c.GetHeader("Authorization"), "Bearer ")
+
+		claims, err := verifyToken(tokenString)
+		if err != nil || (claims.Purpose != "" && claims.Purpose != "mfa_enroll") {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
+			c.Abort()
+			return
+		}
+		// impersonation token ห้ามผูก/เปลี่ยน MFA ของผู้ใช้ที่ถูกสวมรอย
+		if claims.Act != nil {
+			c.JSON(http.StatusForbidden, gin.H{"error": "not allowed while impersonating"})
+			c.Abort()
+			return
+		}
+
+		c.Set("user_id", claims.UserID)
+		c.Set("username", claims.Username)
+
+		c.Next()
+	}
+}
+
+// resolve permissions ครั้งเดียวต่อ request แล้วเก็บไว้ใน context
+func requestPermissions(c *gin.Context, userID int) map[string]bool {
+	if cached, ok := c.Get("permissions"); ok {
+		return cached.(map[string]bool)
+	}
+
+	permissions, err := getUserPermissions(userID)
+	if err != nil {
+		log.Printf("Error checking permission: %v", err)
+		permissions = map[string]bool{}
+	}
+	c.Set("permissions", permissions)
+	return permissions
+}
+
+// ตรวจ permission ของ request ปัจจุบัน (ถ้าเข้ามาด้วย API key ต้องอยู่ใน scopes ด้วย)
+func hasPermission(c *gin.Context, permission string) bool {
+	if !permissionGranted(requestPermissions(c, c.GetInt("user_id")), permission) {
+		return false
+	}
+	if scopes, ok := c.Get("api_key_scopes"); ok {
+		return permissionGranted(scopes.(map[string]bool), permission)
+	}
+	return true
+}
+
+func requirePermission(permission string) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		if _, exists := c.Get("user_id"); !exists {
+			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
+			c.Abort()
+			return
+		}
+
+		// ตรวจสอบ permission
+		if !hasPermission(c, permission) {
+			logSecurityEvent(c, c.GetInt("user_id"), "permission_denied", gin.H{"required": permission})
+			c.JSON(http.StatusForbidden, gin.H{
+				"error":   "insufficient permissions",
+				"required": permission,
+			})
+			c.Abort()
+			return
+		}
+
+		c.Next()
+	}
+}
+
+// ===================== Book Policies =====================
+// ตรวจหลังจากโหลดแถวแล้ว: แก้/ลบได้เฉพาะหนังสือที่ตัวเองสร้าง
+// เว้นแต่มี books:manage_all (หนังสือเก่าที่ไม่มี created_by ต้องใช้ manage_all)
+func authorizeBookChange(c *gin.Context, createdBy sql.NullInt64) bool {
+	if createdBy.Valid && int(createdBy.Int64) == c.GetInt("user_id") {
+		return true
+	}
+	if hasPermission(c, "books:manage_all") {
+		return true
+	}
+
+	logSecurityEvent(c, c.GetInt("user_id"), "permission_denied", gin.H{
+		"required": "books:manage_all",
+		"book_id":  c.Param("id"),
+	})
+	c.JSON(http.StatusForbidden, gin.H{
+		"error":    "you can only modify books you created",
+		"required": "books:manage_all",
+	})
+	return false
+}
+
+// ===================== Book Handlers =====================
+// @Summary Get all books
+// @Description Get details of books
+// @Tags Books
+// @Produce  json
+// @Success 200  {array}  Book
+// @Failure 500  {object}  ErrorResponse
+// @Router  /books [get]
+func getAllBooks(c *gin.Context) {
+    var rows *sql.Rows
+    var err error
+    // ลูกค้าถาม "มีหนังสืออะไรบ้าง"
+    rows, err = db.Query("SELECT id, title, author, isbn, year, price, created_by, created_at, updated_at FROM books")
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    defer rows.Close() // ต้องปิด rows เสมอ เพื่อคืน Connection กลับ pool
+
+    var books []Book
+    for rows.Next() {
+        var book Book
+        err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.Year, &book.Price, &book.CreatedBy, &book.CreatedAt, &book.UpdatedAt)
+        if err != nil {
+            // handle error
+        }
+        books = append(books, book)
+    }
+	if books == nil {
+		books = []Book{}
+	}
+
+	c.JSON(http.StatusOK, books)
+}
+
+func getBook(c *gin.Context) {
+    id := c.Param("id")
+    var book Book
+
+    // QueryRow ใช้เมื่อคาดว่าจะได้ผลลัพธ์ 0 หรือ 1 แถว
+    err := db.QueryRow("SELECT id, title, author FROM books WHERE id = $1", id).Scan(&book.ID, &book.Title, &book.Author)
+
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    c.JSON(http.StatusOK, book)
+}
+
+func createBook(c *gin.Context) {
+    var newBook Book
+
+    if err := c.ShouldBindJSON(&newBook); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    // ใช้ RETURNING เพื่อดึงค่าที่ database generate (id, timestamps)
+    var id int
+    var createdAt, updatedAt time.Time
+
+    userID := c.GetInt("user_id")
+    err := db.QueryRow(
+        `INSERT INTO books (title, author, isbn, year, price, created_by)
+         VALUES ($1, $2, $3, $4, $5, $6)
+         RETURNING id, created_at, updated_at`,
+        newBook.Title, newBook.Author, newBook.ISBN, newBook.Year, newBook.Price, userID,
+    ).Scan(&id, &createdAt, &updatedAt)
+
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+    newBook.ID = id
+    newBook.CreatedBy = &userID
+    newBook.CreatedAt = createdAt
+    newBook.UpdatedAt = updatedAt
+
+	// Log audit
+	logAudit(userID, "create", "books", newBook.ID, gin.H{
+		"title":  newBook.Title,
+		"author": newBook.Author,
+		"isbn":   newBook.ISBN,
+	}, c)
+
+    c.JSON(http.StatusCreated, newBook) // ใช้ 201 Created
+}
+
+func updateBook(c *gin.Context) {
+	var ID int
+
+    id := c.Param("id")
+    var updateBook Book
+
+    if err := c.ShouldBindJSON(&updateBook); err != nil {
+        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+        return
+    }
+
+    tx, err := db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    defer tx.Rollback()
+
+    // โหลดแถวก่อน (ล็อคไว้) เพื่อตรวจ ownership
+    var createdBy sql.NullInt64
+    err = tx.QueryRow("SELECT created_by FROM books WHERE id = $1 FOR UPDATE", id).Scan(&createdBy)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if !authorizeBookChange(c, createdBy) {
+        return
+    }
+
+    var updatedAt time.Time
+    err = tx.QueryRow(
+        `UPDATE books
+         SET title = $1, author = $2, isbn = $3, year = $4, price = $5
+         WHERE id = $6
+         RETURNING id, updated_at`,
+        updateBook.Title, updateBook.Author, updateBook.ISBN,
+        updateBook.Year, updateBook.Price, id,
+    ).Scan(&ID, &updatedAt)
+
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+	updateBook.ID = ID
+	updateBook.UpdatedAt = updatedAt
+	if createdBy.Valid {
+		owner := int(createdBy.Int64)
+		updateBook.CreatedBy = &owner
+	}
+
+	// Log audit
+	userID := c.GetInt("user_id")
+	logAudit(userID, "update", "books", updateBook.ID, gin.H{
+		"title":  updateBook.Title,
+		"author": updateBook.Author,
+	}, c)
+
+	c.JSON(http.StatusOK, updateBook)
+}
+
+func deleteBook(c *gin.Context) {
+    id := c.Param("id")
+
+    tx, err := db.Begin()
+    if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    defer tx.Rollback()
+
+    // โหลดแถวก่อน (ล็อคไว้) เพื่อตรวจ ownership
+    var createdBy sql.NullInt64
+    err = tx.QueryRow("SELECT created_by FROM books WHERE id = $1 FOR UPDATE", id).Scan(&createdBy)
+    if err == sql.ErrNoRows {
+        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
+        return
+    } else if err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if !authorizeBookChange(c, createdBy) {
+        return
+    }
+
+    if _, err := tx.Exec("DELETE FROM books WHERE id = $1", id); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+    if err := tx.Commit(); err != nil {
+        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+        return
+    }
+
+	// Log audit
+	userID := c.GetInt("user_id")
+	logAudit(userID, "delete", "books", id, nil, c)
+
+    c.JSON(http.StatusOK, gin.H{"message": "book deleted successfully"})
+}
+
+// ===================== User Management Handlers =====================
+const userDetailQuery = `
+	SELECT u.id, u.username, u.email, u.is_active, u.email_verified,
+		COALESCE(string_agg(r.name, ',' ORDER BY r.name), ''),
+		u.created_at, u.updated_at, u.last_login
+	FROM users u
+	LEFT JOIN user_roles ur ON u.id = ur.user_id
+	LEFT JOIN roles r ON ur.role_id = r.id
+`
+
+func scanUserDetail(row interface{ Scan(...interface{}) error }) (UserDetail, error) {
+	var user UserDetail
+	var roles string
+	var lastLogin sql.NullTime
+	err := row.Scan(&user.ID, &user.Username, &user.Email, &user.IsActive, &user.EmailVerified,
+		&roles, &user.CreatedAt, &user.UpdatedAt, &lastLogin)
+	if err != nil {
+		return user, err
+	}
+	user.Roles = []string{}
+	if roles != "" {
+		user.Roles = strings.Split(roles, ",")
+	}
+	if lastLogin.Valid {
+		user.LastLogin = &lastLogin.Time
+	}
+	return user, nil
+}
+
+func getUserDetail(id interface{}) (UserDetail, error) {
+	return scanUserDetail(db.QueryRow(userDetailQuery+" WHERE u.id = $1 GROUP BY u.id", id))
+}
+
+// revoke refresh token ทั้งหมดของ user (ใช้ตอน deactivate / เปลี่ยนรหัสผ่าน)
+func revokeAllRefreshTokens(tx *sql.Tx, userID interface{}) (int64, error) {
+	result, err := tx.Exec("UPDATE refresh_tokens SET revoked_at = NOW() WHERE user_id = $1 AND revoked_at IS NULL", userID)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+func listUsers(c *gin.Context) {
+	page, _ := strconv.Atoi(c.DefaultQuery("page", "1"))
+	if page < 1 {
+		page = 1
+	}
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "20"))
+	if limit < 1 || limit > 100 {
+		limit = 20
+	}
+
+	// สร้าง WHERE ตาม filter ที่ส่งมา
+	var conditions []string
+	var args []interface{}
+	if q := strings.TrimSpace(c.Query("q")); q != "" {
+		args = append(args, "%"+q+"%")
+		conditions = append(conditions, fmt.Sprintf("(u.username ILIKE $%d OR u.email ILIKE $%d)", len(args), len(args)))
+	}
+	if active := c.Query("active"); active != "" {
+		isActive, err := strconv.ParseBool(active)
+		if err != nil {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "invalid active filter"})
+			return
+		}
+		args = append(args, isActive)
+		conditions = append(conditions, fmt.Sprintf("u.is_active = $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+
+	var total int
+	if err := db.QueryRow("SELECT COUNT(*) FROM users u"+where, args...).Scan(&total); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	args = append(args, limit, (page-1)*limit)
+	rows, err := db.Query(
+		userDetailQuery+where+fmt.Sprintf(" GROUP BY u.id ORDER BY u.id LIMIT $%d OFFSET $%d", len(args)-1, len(args)),
+		args...,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
+
+	users := []UserDetail{}
+	for rows.Next() {
+		user, err := scanUserDetail(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		users = append(users, user)
+	}
+
+	c.JSON(http.StatusOK, UserListResponse{Data: users, Page: page, Limit: limit, Total: total})
+}
+
+// :id ต้องเป็นตัวเลข (เทียบกับ user_id ของตัวเองได้ตรงๆ เช่น "007" ไม่หลุด guard และไม่ส่ง error ของ DB กลับไป)
+func userIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid user id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func getUser(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	user, err := getUserDetail(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	c.JSON(http.StatusOK, user)
+}
+
+func createUser(c *gin.Context) {
+	var req CreateUserRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+
+	if err := validatePassword(req.Password); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	passwordHash, err := hashPassword(req.Password)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	// admin เป็นคนสร้างให้ จึงถือว่ายืนยันอีเมลแล้ว
+	var id int
+	err = tx.QueryRow(
+		`INSERT INTO users (username, email, password_hash, email_verified)
+		 VALUES ($1, $2, $3, true)
+		 RETURNING id`,
+		req.Username, req.Email, passwordHash,
+	).Scan(&id)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "username or email already registered"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := recordPasswordHistory(tx, id, passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	adminID := c.GetInt("user_id")
+	_, err = tx.Exec(
+		`INSERT INTO user_roles (user_id, role_id, assigned_by)
+		 SELECT $1, id, $2 FROM roles WHERE name = 'user'`,
+		id, adminID,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAudit(adminID, "create", "users", id, gin.H{
+		"username": req.Username,
+		"email":    req.Email,
+	}, c)
+
+	user, _ := getUserDetail(id)
+	c.JSON(http.StatusCreated, user)
+}
+
+// setUserActive คืน handler สำหรับ activate / deactivate
+func setUserActive(active bool) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		id, ok := userIDParam(c)
+		if !ok {
+			return
+		}
+		adminID := c.GetInt("user_id")
+		if !active && id == adminID {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "cannot deactivate your own account"})
+			return
+		}
+
+		tx, err := db.Begin()
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		defer tx.Rollback()
+
+		result, err := tx.Exec("UPDATE users SET is_active = $1, updated_at = NOW() WHERE id = $2", active, id)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+			return
+		}
+
+		// ปิด account แล้วต้อง refresh ไม่ได้อีกทันที
+		var revoked int64
+		if !active {
+			if revoked, err = revokeAllRefreshTokens(tx, id); err != nil {
+				c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+				return
+			}
+		}
+		if err := tx.Commit(); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+
+		action := "activate"
+		if !active {
+			action = "deactivate"
+		}
+		logAudit(adminID, action, "users", id, gin.H{
+			"sessions_revoked": revoked,
+		}, c)
+
+		user, _ := getUserDetail(id)
+		c.JSON(http.StatusOK, user)
+	}
+}
+
+func adminResetPassword(c *gin.Context) {
+	var req AdminPasswordRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	if err := validatePassword(req.NewPassword); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	if err := checkPasswordReuse(tx, id, req.NewPassword); err == errPasswordReused {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	passwordHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to hash password"})
+		return
+	}
+
+	result, err := tx.Exec("UPDATE users SET password_hash = $1, updated_at = NOW() WHERE id = $2", passwordHash, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+	if err := recordPasswordHistory(tx, id, passwordHash); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	revoked, err := revokeAllRefreshTokens(tx, id)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAudit(c.GetInt("user_id"), "reset_password", "users", id, gin.H{
+		"sessions_revoked": revoked,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "password updated"})
+}
+
+// เปลี่ยนอีเมลแล้วต้องยืนยันอีเมลใหม่อีกครั้ง
+func changeUserEmail(c *gin.Context) {
+	var req ChangeEmailRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	var userID int
+	var oldEmail string
+	err = tx.QueryRow("SELECT id, email FROM users WHERE id = $1 FOR UPDATE", id).Scan(&userID, &oldEmail)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = tx.Exec("UPDATE users SET email = $1, email_verified = false, updated_at = NOW() WHERE id = $2", req.Email, userID)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "email already registered"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	token, err := createEmailVerificationToken(tx, userID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	if err := sendVerificationEmail(req.Email, token); err != nil {
+		log.Printf("Error sending verification email: %v", err)
+	}
+
+	logAudit(c.GetInt("user_id"), "change_email", "users", userID, gin.H{
+		"old_email": oldEmail,
+		"new_email": req.Email,
+	}, c)
+
+	user, _ := getUserDetail(userID)
+	c.JSON(http.StatusOK, user)
+}
+
+func deleteUser(c *gin.Context) {
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	adminID := c.GetInt("user_id")
+	if id == adminID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot delete your own account"})
+		return
+	}
+
+	result, err := db.Exec("DELETE FROM users WHERE id = $1", id)
+	// user ที่มีประวัติใน audit_logs หรือเคยมอบ role ให้คนอื่นลบไม่ได้ (FK) ให้ deactivate แทน
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusConflict, gin.H{"error": "user has audit history, deactivate instead"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	}
+
+	logAudit(adminID, "delete", "users", id, nil, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "user deleted successfully"})
+}
 
-	err := db.QueryRow(query, req.Username).Scan(
-		&user.ID,
-		&user.Username,
-		&user.Email,
-		&user.PasswordHash,
-		&user.IsActive,
-	)
+// ===================== Impersonation =====================
+var impersonationTTL = getEnvDuration("IMPERSONATION_TTL", 10*time.Minute)
+
+func impersonateUser(c *gin.Context) {
+	// ห้ามซ้อน (impersonate ต่อจาก impersonation token) และห้ามใช้ API key
+	if _, ok := c.Get("actor_id"); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "already impersonating"})
+		return
+	}
+	if _, ok := c.Get("api_key_id"); ok {
+		c.JSON(http.StatusForbidden, gin.H{"error": "API keys cannot impersonate users"})
+		return
+	}
+
+	var req ImpersonateRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
 
+	actor := TokenActor{UserID: c.GetInt("user_id"), Username: c.GetString("username")}
+	id, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	target, err := getUserDetail(id)
 	if err == sql.ErrNoRows {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
 		return
 	} else if err != nil {
-		log.Printf("Database error: %v", err)
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "internal server error"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if target.ID == actor.UserID {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "cannot impersonate yourself"})
+		return
+	}
+	if !target.IsActive {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "user is deactivated"})
 		return
 	}
 
-	// ตรวจสอบว่า user active หรือไม่
-	if !user.IsActive {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "account is disabled"})
+	// admin หรือคนที่ impersonate ได้เอง ห้ามสวมรอย (ไม่งั้นจะได้สิทธิ์เพิ่ม)
+	targetPermissions, err := getUserPermissions(target.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if slices.Contains(target.Roles, "admin") || permissionGranted(targetPermissions, "users:impersonate") {
+		logSecurityEvent(c, actor.UserID, "permission_denied", gin.H{
+			"required":       "users:impersonate",
+			"target_user_id": target.ID,
+			"reason":         "target_is_admin",
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot impersonate an administrator"})
 		return
 	}
 
-	// ตรวจสอบ password
-	if err := verifyPassword(user.PasswordHash, req.Password); err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid credentials"})
+	// สิทธิ์ของ target ต้องเป็น subset ของสิทธิ์ผู้ที่สวมรอย ไม่อย่างนั้น impersonate = ยกระดับสิทธิ์ตัวเอง
+	actorPermissions := requestPermissions(c, actor.UserID)
+	var exceeding []string
+	for grant := range targetPermissions {
+		if !permissionGranted(actorPermissions, grant) {
+			exceeding = append(exceeding, grant)
+		}
+	}
+	if len(exceeding) > 0 {
+		sort.Strings(exceeding)
+		logSecurityEvent(c, actor.UserID, "permission_denied", gin.H{
+			"required":       exceeding,
+			"target_user_id": target.ID,
+			"reason":         "target_has_more_permissions",
+		})
+		c.JSON(http.StatusForbidden, gin.H{"error": "cannot impersonate a user with permissions you do not have", "missing": exceeding})
 		return
 	}
 
-	// ดึง roles ของ user
-	roles, err := getUserRoles(user.ID)
+	token, expiresAt, err := generateImpersonationToken(target, actor, impersonationTTL)
 	if err != nil {
-		log.Printf("Error getting roles: %v", err)
-		roles = []string{} // ถ้าดึงไม่ได้ให้เป็น empty array
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate token"})
+		return
 	}
 
-	// สร้าง tokens
-	accessToken, err := generateAccessToken(user.ID, user.Username, roles)
+	logAudit(actor.UserID, "impersonate", "users", target.ID, gin.H{
+		"target_username": target.Username,
+		"reason":          req.Reason,
+		"expires_at":      expiresAt.UTC().Format(time.RFC3339),
+	}, c)
+
+	c.JSON(http.StatusOK, ImpersonationResponse{
+		AccessToken: token,
+		ExpiresAt:   expiresAt,
+		User:        target,
+		Actor:       actor,
+	})
+}
+
+// ===================== Role & Permission Handlers =====================
+var roleNamePattern = regexp.MustCompile(`^[a-z][a-z0-9_-]*$`)
+
+const roleQuery = `
+	SELECT r.id, r.name, COALESCE(r.description, ''), r.is_system, r.require_mfa,
+		COALESCE(string_agg(p.name, ',' ORDER BY p.name), ''), r.created_at
+	FROM roles r
+	LEFT JOIN role_permissions rp ON r.id = rp.role_id
+	LEFT JOIN permissions p ON rp.permission_id = p.id
+`
+
+func scanRole(row interface{ Scan(...interface{}) error }) (Role, error) {
+	var role Role
+	var permissions string
+	err := row.Scan(&role.ID, &role.Name, &role.Description, &role.IsSystem, &role.RequireMFA, &permissions, &role.CreatedAt)
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
-		return
+		return role, err
 	}
+	role.Permissions = []string{}
+	if permissions != "" {
+		role.Permissions = strings.Split(permissions, ",")
+	}
+	return role, nil
+}
 
-	refreshToken, err := generateRefreshToken(user.ID, user.Username)
+// :id ของ role ต้องเป็นตัวเลข (ไม่ส่ง error ของ DB กลับไปเป็น 500)
+func roleIDParam(c *gin.Context) (int, bool) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id <= 0 {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid role id"})
+		return 0, false
+	}
+	return id, true
+}
+
+func getRoleByID(id interface{}) (Role, error) {
+	return scanRole(db.QueryRow(roleQuery+" WHERE r.id = $1 GROUP BY r.id", id))
+}
+
+func listRoles(c *gin.Context) {
+	rows, err := db.Query(roleQuery + " GROUP BY r.id ORDER BY r.id")
 	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate refresh token"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer rows.Close()
 
-	// บันทึก refresh token ในฐานข้อมูล
-	expiresAt := time.Now().Add(7 * 24 * time.Hour)
-	if err := storeRefreshToken(user.ID, refreshToken, expiresAt); err != nil {
-		log.Printf("Error storing refresh token: %v", err)
-		// ไม่ return error เพราะ token ยังใช้ได้
+	roles := []Role{}
+	for rows.Next() {
+		role, err := scanRole(rows)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		roles = append(roles, role)
 	}
 
-	// อัพเดท last_login
-	db.Exec("UPDATE users SET last_login = NOW() WHERE id = $1", user.ID)
+	c.JSON(http.StatusOK, roles)
+}
 
-	// Log audit
-	logAudit(user.ID, "login", "auth", nil, gin.H{
-		"username": user.Username,
-	}, c)
+func getRole(c *gin.Context) {
+	id, ok := roleIDParam(c)
+	if !ok {
+		return
+	}
+	role, err := getRoleByID(id)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-	// ส่ง response
-	c.JSON(http.StatusOK, LoginResponse{
-		AccessToken:  accessToken,
-		RefreshToken: refreshToken,
-		User: UserInfo{
-			ID:       user.ID,
-			Username: user.Username,
-			Email:    user.Email,
-			Roles:    roles,
-		},
-	})
+	c.JSON(http.StatusOK, role)
 }
 
-func refreshTokenHandler(c *gin.Context) {
-	var req RefreshRequest
-	if err := c.ShouldBindJSON(&req); err != nil {
-		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+func listPermissions(c *gin.Context) {
+	rows, err := db.Query("SELECT id, name, COALESCE(description, ''), resource, action FROM permissions ORDER BY resource, action")
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer rows.Close()
 
-	// ตรวจสอบ refresh token
-	userID, valid := isRefreshTokenValid(req.RefreshToken)
-	if !valid {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired refresh token"})
+	permissions := []Permission{}
+	for rows.Next() {
+		var p Permission
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.Resource, &p.Action); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		permissions = append(permissions, p)
+	}
+
+	c.JSON(http.StatusOK, permissions)
+}
+
+func createRole(c *gin.Context) {
+	var req CreateRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	if !roleNamePattern.MatchString(req.Name) {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "role name must be lowercase letters, digits, '_' or '-'"})
 		return
 	}
 
-	// ดึงข้อมูล user
-	var username string
-	err := db.QueryRow("SELECT username FROM users WHERE id = $1", userID).Scan(&username)
+	tx, err := db.Begin()
 	if err != nil {
-		c.JSON(http.StatusUnauthorized, gin.H{"error": "user not found"})
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
+	defer tx.Rollback()
 
-	// ดึง roles
-	roles, err := getUserRoles(userID)
-	if err != nil {
-		roles = []string{}
+	var id int
+	err = tx.QueryRow(
+		"INSERT INTO roles (name, description) VALUES ($1, $2) RETURNING id",
+		req.Name, req.Description,
+	).Scan(&id)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23505" {
+		c.JSON(http.StatusConflict, gin.H{"error": "role already exists"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	// สร้าง access token ใหม่
-	accessToken, err := generateAccessToken(userID, username, roles)
-	if err != nil {
-		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to generate access token"})
+	for _, name := range req.Permissions {
+		result, err := tx.Exec(
+			`INSERT INTO role_permissions (role_id, permission_id)
+			 SELECT $1, id FROM permissions WHERE name = $2`,
+			id, name,
+		)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if rows, _ := result.RowsAffected(); rows == 0 {
+			c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission", "permission": name})
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{
-		"access_token": accessToken,
-	})
+	logAudit(c.GetInt("user_id"), "create", "roles", id, gin.H{
+		"name":        req.Name,
+		"permissions": req.Permissions,
+	}, c)
+
+	role, _ := getRoleByID(id)
+	c.JSON(http.StatusCreated, role)
 }
 
-func logout(c *gin.Context) {
-	// ดึง refresh token จาก request
-	var req RefreshRequest
+func deleteRole(c *gin.Context) {
+	id, ok := roleIDParam(c)
+	if !ok {
+		return
+	}
+
+	var name string
+	var isSystem bool
+	err := db.QueryRow("SELECT name, is_system FROM roles WHERE id = $1", id).Scan(&name, &isSystem)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	// role ของระบบ (admin, user) ลบไม่ได้
+	if isSystem {
+		c.JSON(http.StatusForbidden, gin.H{"error": "system roles cannot be deleted"})
+		return
+	}
+
+	// user_roles / role_permissions ถูกลบตาม (ON DELETE CASCADE)
+	if _, err := db.Exec("DELETE FROM roles WHERE id = $1 AND is_system = false", id); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	logAudit(c.GetInt("user_id"), "delete", "roles", id, gin.H{
+		"name": name,
+	}, c)
+
+	c.JSON(http.StatusOK, gin.H{"message": "role deleted successfully"})
+}
+
+func attachPermission(c *gin.Context) {
+	var req RolePermissionRequest
 	if err := c.ShouldBindJSON(&req); err != nil {
 		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
 		return
 	}
+	id, ok := roleIDParam(c)
+	if !ok {
+		return
+	}
 
-	// Revoke refresh token
-	if err := revokeRefreshToken(req.RefreshToken); err != nil {
-		log.Printf("Error revoking token: %v", err)
+	var permissionID int
+	err := db.QueryRow("SELECT id FROM permissions WHERE name = $1", req.Permission).Scan(&permissionID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown permission", "permission": req.Permission})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	// Log audit (ถ้ามี user_id ใน context)
-	if userID, exists := c.Get("user_id"); exists {
-		logAudit(userID.(int), "logout", "auth", nil, nil, c)
+	_, err = db.Exec(
+		`INSERT INTO role_permissions (role_id, permission_id)
+		 VALUES ($1, $2)
+		 ON CONFLICT DO NOTHING`,
+		id, permissionID,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
 
-	c.JSON(http.StatusOK, gin.H{"message": "logged out successfully"})
+	logAudit(c.GetInt("user_id"), "attach_permission", "roles", id, gin.H{
+		"permission": req.Permission,
+	}, c)
+
+	role, _ := getRoleByID(id)
+	c.JSON(http.StatusOK, role)
 }
 
-// ===================== Middleware =====================
-func authMiddleware() gin.HandlerFunc {
-	return func(c *gin.Context) {
-		// ดึง token จาก Authorization header
-		authHeader := c.GetHeader("Authorization")
-		if authHeader == "" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "authorization header required"})
-			c.Abort()
-			return
-		}
+func detachPermission(c *gin.Context) {
+	id, ok := roleIDParam(c)
+	if !ok {
+		return
+	}
+	permission := c.Param("permission")
 
-		// ตรวจสอบ format: "Bearer <token>"
-		parts := strings.Split(authHeader, " ")
-		if len(parts) != 2 || parts[0] != "Bearer" {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid authorization header format"})
-			c.Abort()
-			return
-		}
+	result, err := db.Exec(
+		`DELETE FROM role_permissions
+		 WHERE role_id = $1 AND permission_id = (SELECT id FROM permissions WHERE name = $2)`,
+		id, permission,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "role does not have this permission"})
+		return
+	}
 
-		tokenString := parts[1]
+	logAudit(c.GetInt("user_id"), "detach_permission", "roles", id, gin.H{
+		"permission": permission,
+	}, c)
 
-		// Verify token
-		claims, err := verifyToken(tokenString)
-		if err != nil {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "invalid or expired token"})
-			c.Abort()
-			return
-		}
+	role, _ := getRoleByID(id)
+	c.JSON(http.StatusOK, role)
+}
 
-		// เก็บข้อมูล user ใน context
-		c.Set("user_id", claims.UserID)
-		c.Set("username", claims.Username)
-		c.Set("roles", claims.Roles)
+func assignRole(c *gin.Context) {
+	var req AssignRoleRequest
+	if err := c.ShouldBindJSON(&req); err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "invalid request"})
+		return
+	}
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	adminID := c.GetInt("user_id")
 
-		c.Next()
+	var roleID int
+	err := db.QueryRow("SELECT id FROM roles WHERE name = $1", req.Role).Scan(&roleID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "unknown role", "role": req.Role})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+
+	_, err = db.Exec(
+		`INSERT INTO user_roles (user_id, role_id, assigned_by)
+		 VALUES ($1, $2, $3)
+		 ON CONFLICT (user_id, role_id) DO NOTHING`,
+		userID, roleID, adminID,
+	)
+	if pqErr, ok := err.(*pq.Error); ok && pqErr.Code == "23503" {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
 	}
+
+	logAudit(adminID, "assign_role", "users", userID, gin.H{
+		"role": req.Role,
+	}, c)
+
+	user, _ := getUserDetail(userID)
+	c.JSON(http.StatusOK, user)
 }
 
-func requirePermission(permission string) gin.HandlerFunc {
-	return func(c *gin.Context) {
-		userID, exists := c.Get("user_id")
-		if !exists {
-			c.JSON(http.StatusUnauthorized, gin.H{"error": "unauthorized"})
-			c.Abort()
+func unassignRole(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	roleName := c.Param("role")
+
+	tx, err := db.Begin()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec(
+		`DELETE FROM user_roles
+		 WHERE user_id = $1 AND role_id = (SELECT id FROM roles WHERE name = $2)`,
+		userID, roleName,
+	)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	if rows, _ := result.RowsAffected(); rows == 0 {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user does not have this role"})
+		return
+	}
+
+	// ต้องเหลือ admin อย่างน้อยหนึ่งคนเสมอ
+	if roleName == "admin" {
+		var admins int
+		err := tx.QueryRow(
+			`SELECT COUNT(*) FROM user_roles ur
+			 JOIN roles r ON ur.role_id = r.id
+			 WHERE r.name = 'admin'`,
+		).Scan(&admins)
+		if err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
 			return
 		}
-
-		// ตรวจสอบ permission
-		hasPermission := checkUserPermission(userID.(int), permission)
-		if !hasPermission {
-			c.JSON(http.StatusForbidden, gin.H{
-				"error":   "insufficient permissions",
-				"required": permission,
-			})
-			c.Abort()
+		if admins == 0 {
+			c.JSON(http.StatusConflict, gin.H{"error": "cannot remove the last admin"})
 			return
 		}
-
-		c.Next()
 	}
-}
+	if err := tx.Commit(); err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-// ===================== Book Handlers =====================
-// @Summary Get all books
-// @Description Get details of books
-// @Tags Books
-// @Produce  json
-// @Success 200  {array}  Book
-// @Failure 500  {object}  ErrorResponse
-// @Router  /books [get]
-func getAllBooks(c *gin.Context) {
-    var rows *sql.Rows
-    var err error
-    // ลูกค้าถาม "มีหนังสืออะไรบ้าง"
-    rows, err = db.Query("SELECT id, title, author, isbn, year, price, created_at, updated_at FROM books")
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-    defer rows.Close() // ต้องปิด rows เสมอ เพื่อคืน Connection กลับ pool
+	logAudit(c.GetInt("user_id"), "unassign_role", "users", userID, gin.H{
+		"role": roleName,
+	}, c)
 
-    var books []Book
-    for rows.Next() {
-        var book Book
-        err := rows.Scan(&book.ID, &book.Title, &book.Author, &book.ISBN, &book.Year, &book.Price, &book.CreatedAt, &book.UpdatedAt)
-        if err != nil {
-            // handle error
-        }
-        books = append(books, book)
-    }
-	if books == nil {
-		books = []Book{}
+	user, _ := getUserDetail(userID)
+	c.JSON(http.StatusOK, user)
+}
+
+// อธิบายว่าทำไม user มี (หรือไม่มี) permission ที่ระบุ
+func explainPermission(c *gin.Context) {
+	userID, ok := userIDParam(c)
+	if !ok {
+		return
+	}
+	permission := c.Query("permission")
+	if !strings.Contains(permission, ":") {
+		c.JSON(http.StatusBadRequest, gin.H{"error": "permission must be in resource:action format"})
+		return
 	}
 
-	c.JSON(http.StatusOK, books)
-}
+	user, err := getUserDetail(userID)
+	if err == sql.ErrNoRows {
+		c.JSON(http.StatusNotFound, gin.H{"error": "user not found"})
+		return
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-func getBook(c *gin.Context) {
-    id := c.Param("id")
-    var book Book
+	rows, err := db.Query(`
+		SELECT r.name, p.name
+		FROM user_roles ur
+		JOIN roles r ON ur.role_id = r.id
+		JOIN role_permissions rp ON r.id = rp.role_id
+		JOIN permissions p ON rp.permission_id = p.id
+		WHERE ur.user_id = $1
+		ORDER BY r.name, p.name
+	`, user.ID)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
+	defer rows.Close()
 
-    // QueryRow ใช้เมื่อคาดว่าจะได้ผลลัพธ์ 0 หรือ 1 แถว
-    err := db.QueryRow("SELECT id, title, author FROM books WHERE id = $1", id).Scan(&book.ID, &book.Title, &book.Author)
+	matches := []gin.H{}
+	for rows.Next() {
+		var role, grant string
+		if err := rows.Scan(&role, &grant); err != nil {
+			c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+			return
+		}
+		if reason, ok := explainGrant(grant, permission); ok {
+			matches = append(matches, gin.H{"role": role, "grant": grant, "reason": reason})
+		}
+	}
 
-    if err == sql.ErrNoRows {
-        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
-        return
-    } else if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
+	response := gin.H{
+		"user_id":    user.ID,
+		"username":   user.Username,
+		"roles":      user.Roles,
+		"permission": permission,
+		"granted":    len(matches) > 0,
+		"matches":    matches,
+	}
+	if len(matches) == 0 {
+		response["reason"] = "no role grants this permission"
+	}
+	if !user.IsActive {
+		response["note"] = "user is deactivated"
+	}
 
-    c.JSON(http.StatusOK, book)
+	c.JSON(http.StatusOK, response)
 }
 
-func createBook(c *gin.Context) {
-    var newBook Book
+// ===================== Audit Log Endpoints =====================
+// เรียงจากใหม่ไปเก่าด้วย id และแบ่งหน้าแบบ keyset (WHERE id < cursor)
+// ไม่ใช้ OFFSET เพราะตารางนี้โตเรื่อยๆ และมีแถวใหม่เข้ามาระหว่างไล่หน้า
+const auditLogQuery = `
+	SELECT a.id, a.user_id, u.username, a.action, COALESCE(a.resource, ''), COALESCE(a.resource_id, ''),
+	       COALESCE(a.details, 'null'::jsonb), COALESCE(a.ip_address, ''), COALESCE(a.user_agent, ''), a.created_at
+	FROM audit_logs a
+	LEFT JOIN users u ON u.id = a.user_id
+`
 
-    if err := c.ShouldBindJSON(&newBook); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
-    }
+const auditExportBatchSize = 1000
 
-    // ใช้ RETURNING เพื่อดึงค่าที่ database generate (id, timestamps)
-    var id int
-    var createdAt, updatedAt time.Time
+// แปลง query string เป็นเงื่อนไข WHERE (user_id, action, resource, resource_id, from, to)
+func auditLogFilters(c *gin.Context) ([]string, []interface{}, error) {
+	var conditions []string
+	var args []interface{}
 
-    err := db.QueryRow(
-        `INSERT INTO books (title, author, isbn, year, price)
-         VALUES ($1, $2, $3, $4, $5)
-         RETURNING id, created_at, updated_at`,
-        newBook.Title, newBook.Author, newBook.ISBN, newBook.Year, newBook.Price,
-    ).Scan(&id, &createdAt, &updatedAt)
+	if userID := c.Query("user_id"); userID != "" {
+		id, err := strconv.Atoi(userID)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid user_id")
+		}
+		args = append(args, id)
+		conditions = append(conditions, fmt.Sprintf("a.user_id = $%d", len(args)))
+	}
+	for _, column := range []string{"action", "resource", "resource_id"} {
+		if value := c.Query(column); value != "" {
+			args = append(args, value)
+			conditions = append(conditions, fmt.Sprintf("a.%s = $%d", column, len(args)))
+		}
+	}
+	for _, bound := range []struct{ param, op string }{{"from", ">="}, {"to", "<"}} {
+		param, op := bound.param, bound.op
+		value := c.Query(param)
+		if value == "" {
+			continue
+		}
+		t, err := time.Parse(time.RFC3339, value)
+		if err != nil {
+			return nil, nil, fmt.Errorf("invalid %s, expected RFC3339 timestamp", param)
+		}
+		args = append(args, t)
+		conditions = append(conditions, fmt.Sprintf("a.created_at %s $%d", op, len(args)))
+	}
 
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
+	return conditions, args, nil
+}
 
-    newBook.ID = id
-    newBook.CreatedAt = createdAt
-    newBook.UpdatedAt = updatedAt
+func queryAuditLogs(conditions []string, args []interface{}, cursor, limit int) ([]AuditLog, error) {
+	if cursor > 0 {
+		args = append(args, cursor)
+		conditions = append(conditions, fmt.Sprintf("a.id < $%d", len(args)))
+	}
+	where := ""
+	if len(conditions) > 0 {
+		where = " WHERE " + strings.Join(conditions, " AND ")
+	}
+	args = append(args, limit)
 
-	// Log audit
-	userID := c.GetInt("user_id")
-	logAudit(userID, "create", "books", newBook.ID, gin.H{
-		"title":  newBook.Title,
-		"author": newBook.Author,
-		"isbn":   newBook.ISBN,
-	}, c)
+	rows, err := db.Query(auditLogQuery+where+fmt.Sprintf(" ORDER BY a.id DESC LIMIT $%d", len(args)), args...)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
 
-    c.JSON(http.StatusCreated, newBook) // ใช้ 201 Created
+	logs := []AuditLog{}
+	for rows.Next() {
+		var entry AuditLog
+		var userID sql.NullInt64
+		var username sql.NullString
+		var details []byte
+		if err := rows.Scan(&entry.ID, &userID, &username, &entry.Action, &entry.Resource, &entry.ResourceID,
+			&details, &entry.IPAddress, &entry.UserAgent, &entry.CreatedAt); err != nil {
+			return nil, err
+		}
+		if userID.Valid {
+			id := int(userID.Int64)
+			entry.UserID = &id
+		}
+		if username.Valid {
+			entry.Username = &username.String
+		}
+		entry.Details = details
+		logs = append(logs, entry)
+	}
+	return logs, rows.Err()
 }
 
-func updateBook(c *gin.Context) {
-	var ID int
+func listAuditLogs(c *gin.Context) {
+	conditions, args, err := auditLogFilters(c)
+	if err != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
+		return
+	}
+	cursor, _ := strconv.Atoi(c.Query("cursor"))
 
-    id := c.Param("id")
-    var updateBook Book
+	switch format := c.DefaultQuery("format", "json"); format {
+	case "json":
+	case "csv", "ndjson":
+		exportAuditLogs(c, format, conditions, args, cursor)
+		return
+	default:
+		c.JSON(http.StatusBadRequest, gin.H{"error": "format must be json, csv or ndjson"})
+		return
+	}
 
-    if err := c.ShouldBindJSON(&updateBook); err != nil {
-        c.JSON(http.StatusBadRequest, gin.H{"error": err.Error()})
-        return
-    }
+	limit, _ := strconv.Atoi(c.DefaultQuery("limit", "50"))
+	if limit < 1 || limit > 500 {
+		limit = 50
+	}
 
-    var updatedAt time.Time
-    err := db.QueryRow(
-        `UPDATE books
-         SET title = $1, author = $2, isbn = $3, year = $4, price = $5
-         WHERE id = $6
-         RETURNING id, updated_at`,
-        updateBook.Title, updateBook.Author, updateBook.ISBN,
-        updateBook.Year, updateBook.Price, id,
-    ).Scan(&ID, &updatedAt)
+	logs, err := queryAuditLogs(conditions, args, cursor, limit)
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-    if err == sql.ErrNoRows {
-        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
-        return
-    } else if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
-	updateBook.ID = ID
-	updateBook.UpdatedAt = updatedAt
+	response := AuditLogListResponse{Data: logs, Limit: limit}
+	if len(logs) == limit {
+		response.NextCursor = &logs[len(logs)-1].ID
+	}
+	c.JSON(http.StatusOK, response)
+}
 
-	// Log audit
-	userID := c.GetInt("user_id")
-	logAudit(userID, "update", "books", updateBook.ID, gin.H{
-		"title":  updateBook.Title,
-		"author": updateBook.Author,
+// กัน CSV/formula injection: cell ที่ขึ้นต้นด้วย = + - @ tab หรือ CR จะถูก Excel/Sheets ตีความเป็นสูตร
+// เติม ' นำหน้าให้กลายเป็นข้อความธรรมดา (username, user_agent, details มาจากผู้ใช้ได้)
+func csvSafe(value string) string {
+	if value != "" && strings.ContainsRune("=+-@\t\r", rune(value[0])) {
+		return "'" + value
+	}
+	return value
+}
+
+// export ทุกแถวที่ตรง filter โดยดึงทีละ batch แล้ว stream ออกไปเลย (ไม่โหลดทั้งหมดเข้า memory)
+func exportAuditLogs(c *gin.Context, format string, conditions []string, args []interface{}, cursor int) {
+	logAudit(c.GetInt("user_id"), "export", "audit_logs", nil, gin.H{
+		"format":  format,
+		"filters": c.Request.URL.Query(),
 	}, c)
 
-	c.JSON(http.StatusOK, updateBook)
-}
+	filename := fmt.Sprintf("audit-logs-%s.%s", time.Now().Format("20060102-150405"), format)
+	c.Header("Content-Disposition", fmt.Sprintf(`attachment; filename="%s"`, filename))
+	if format == "csv" {
+		c.Header("Content-Type", "text/csv; charset=utf-8")
+	} else {
+		c.Header("Content-Type", "application/x-ndjson")
+	}
+	c.Status(http.StatusOK)
 
-func deleteBook(c *gin.Context) {
-    id := c.Param("id")
+	csvWriter := csv.NewWriter(c.Writer)
+	jsonEncoder := json.NewEncoder(c.Writer)
+	if format == "csv" {
+		csvWriter.Write([]string{"id", "user_id", "username", "action", "resource", "resource_id", "details", "ip_address", "user_agent", "created_at"})
+	}
 
-    result, err := db.Exec("DELETE FROM books WHERE id = $1", id)
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
+	for {
+		logs, err := queryAuditLogs(conditions, args, cursor, auditExportBatchSize)
+		if err != nil {
+			// header ส่งไปแล้ว แจ้ง error ได้แค่ใน log
+			log.Printf("Error exporting audit logs: %v", err)
+			return
+		}
 
-    rowsAffected, err := result.RowsAffected()
-    if err != nil {
-        c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
-        return
-    }
+		for _, entry := range logs {
+			if format == "ndjson" {
+				jsonEncoder.Encode(entry)
+				continue
+			}
+			var userID, username string
+			if entry.UserID != nil {
+				userID = strconv.Itoa(*entry.UserID)
+			}
+			if entry.Username != nil {
+				username = *entry.Username
+			}
+			csvWriter.Write([]string{
+				strconv.Itoa(entry.ID), userID, csvSafe(username), csvSafe(entry.Action), csvSafe(entry.Resource),
+				csvSafe(entry.ResourceID), csvSafe(string(entry.Details)), csvSafe(entry.IPAddress),
+				csvSafe(entry.UserAgent), entry.CreatedAt.Format(time.RFC3339),
+			})
+		}
+		csvWriter.Flush()
+		c.Writer.Flush()
 
-    if rowsAffected == 0 {
-        c.JSON(http.StatusNotFound, gin.H{"error": "book not found"})
-        return
-    }
+		if len(logs) < auditExportBatchSize {
+			return
+		}
+		cursor = logs[len(logs)-1].ID
+	}
+}
 
-	// Log audit
-	userID := c.GetInt("user_id")
-	logAudit(userID, "delete", "books", id, nil, c)
+func verifyAuditLogs(c *gin.Context) {
+	report, err := verifyAuditChain()
+	if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": err.Error()})
+		return
+	}
 
-    c.JSON(http.StatusOK, gin.H{"message": "book deleted successfully"})
+	c.JSON(http.StatusOK, report)
 }
 
 // @title           Bookstore API with Authentication
@@ -678,21 +5226,59 @@ func deleteBook(c *gin.Context) {
 // @host            localhost:8080
 // @BasePath        /api/v1
 func main() {
+	initRedaction()
+	initJWTKeys()
+	initMFAKey()
+	initBcryptCost()
+	initPasswordPolicy()
 	initDB()
 	defer db.Close()
 
+	// go run . verify-audit: ตรวจ audit chain จาก command line (exit 1 ถ้า chain ขาด)
+	if len(os.Args) > 1 && os.Args[1] == "verify-audit" {
+		report, err := verifyAuditChain()
+		if err != nil {
+			log.Fatal("failed to verify audit log: ", err)
+		}
+		out, _ := json.MarshalIndent(report, "", "  ")
+		fmt.Println(string(out))
+		if !report.Valid {
+			os.Exit(1)
+		}
+		return
+	}
+
+	initAuditWriter()
+	listenForPermissionChanges()
+	go runAuditCheckpoints()
+	initMailer()
+
+	// request log, panic dump และ log ทั่วไปผ่าน redaction ก่อนพิมพ์
+	gin.DefaultWriter = redactingWriter{os.Stdout}
+	gin.DefaultErrorWriter = redactingWriter{os.Stderr}
+	log.SetOutput(redactingWriter{os.Stderr})
+
 	r := gin.Default()
-	r.Use(cors.Default())
+	// ค่า default ของ gin เชื่อ X-Forwarded-For จากทุกที่ ใครก็ปลอม IP ได้ (ข้าม lockout ราย IP หรือล็อค IP คนอื่น)
+	if err := r.SetTrustedProxies(trustedProxies()); err != nil {
+		log.Fatal("invalid TRUSTED_PROXIES: ", err)
+	}
+	r.Use(cors.New(corsConfig()))
+	r.Use(redactErrorResponses())
 
 	// ===================== Public Endpoints =====================
 	// Swagger documentation
 	r.GET("/docs/*any", ginSwagger.WrapHandler(swaggerFiles.Handler))
 
+	// Public keys สำหรับ verify JWT (service อื่นใช้ได้โดยไม่ต้องมี secret)
+	r.GET("/.well-known/jwks.json", jwksHandler)
+
 	// Health check endpoint (for Docker healthcheck)
 	r.GET("/health", func(c *gin.Context){
 		err := db.Ping()
 		if err != nil {
-			c.JSON(http.StatusServiceUnavailable, gin.H{"message":"unhealthy", "error":err.Error()})
+			log.Printf("Health check failed: %v", err)
+			c.JSON(http.StatusServiceUnavailable, gin.H{"message":"unhealthy"})
 			return
 		}
 		c.JSON(http.StatusOK, gin.H{"message" : "healthy"})
@@ -704,6 +5290,28 @@ func main() {
 		auth.POST("/login", login)           // Login และรับ tokens
 		auth.POST("/refresh", refreshTokenHandler)  // Refresh access token
 		auth.POST("/logout", logout)         // Logout และ revoke token
+		auth.POST("/register", register)     // สมัครสมาชิก (ต้องยืนยันอีเมล)
+		auth.GET("/verify-email", verifyEmail)                // ยืนยันอีเมลจากลิงก์
+		auth.POST("/verify-email/resend", resendVerification) // ขอลิงก์ยืนยันใหม่
+		auth.POST("/password/forgot", forgotPassword)         // ขอลิงก์ตั้งรหัสผ่านใหม่
+		auth.POST("/password/reset", resetPassword)           // ตั้งรหัสผ่านใหม่ด้วย token
+
+		// Two-factor authentication (TOTP)
+		auth.POST("/login/mfa", loginMFA)                                // ขั้นที่สองของ login
+		auth.POST("/mfa/enroll", mfaEnrollmentMiddleware(), mfaEnroll)   // ได้ otpauth URI
+		auth.POST("/mfa/confirm", mfaEnrollmentMiddleware(), mfaConfirm) // ยืนยันด้วย code แรก
+		// ปิด MFA (ต้องใส่ code)
+		auth.POST("/mfa/disable", authMiddleware(), denyAPIKey(), denyImpersonation(), mfaDisable)
+
+		// Sessions / devices ของตัวเอง
+		auth.GET("/sessions", authMiddleware(), denyAPIKey(), listSessions)
+		auth.DELETE("/sessions/:session_id", authMiddleware(), denyAPIKey(), denyImpersonation(), revokeSession)
+		auth.POST("/logout-all", authMiddleware(), denyAPIKey(), denyImpersonation(), logoutAll)
+
+		// API keys สำหรับ script / integration
+		auth.GET("/api-keys", authMiddleware(), denyAPIKey(), listAPIKeys)
+		auth.POST("/api-keys", authMiddleware(), denyAPIKey(), denyImpersonation(), createAPIKey)
+		auth.DELETE("/api-keys/:key_id", authMiddleware(), denyAPIKey(), denyImpersonation(), revokeAPIKey)
 	}
 
 	// ===================== Protected API Endpoints =====================
@@ -730,7 +5338,150 @@ func main() {
 		api.DELETE("/books/:id",
 			requirePermission("books:delete"),
 			deleteBook)
+
+		// Users endpoints (admin)
+		api.GET("/users",
+			requirePermission("users:read"),
+			listUsers)
+
+		api.GET("/users/:id",
+			requirePermission("users:read"),
+			getUser)
+
+		api.POST("/users",
+			requirePermission("users:create"),
+			createUser)
+
+		api.PUT("/users/:id/email",
+			requirePermission("users:update"),
+			changeUserEmail)
+
+		api.PUT("/users/:id/password",
+			requirePermission("users:update"),
+			adminResetPassword)
+
+		api.POST("/users/:id/activate",
+			requirePermission("users:update"),
+			setUserActive(true))
+
+		api.POST("/users/:id/deactivate",
+			requirePermission("users:update"),
+			setUserActive(false))
+
+		api.DELETE("/users/:id",
+			requirePermission("users:delete"),
+			deleteUser)
+
+		// จัดการ sessions ของ user คนอื่น
+		// ออก token อายุสั้นเพื่อดูระบบในมุมของ user (ห้าม admin)
+		api.POST("/users/:id/impersonate",
+			requirePermission("users:impersonate"),
+			impersonateUser)
+
+		api.GET("/users/:id/sessions",
+			requirePermission("users:update"),
+			listSessions)
+
+		api.DELETE("/users/:id/sessions/:session_id",
+			requirePermission("users:update"),
+			revokeSession)
+
+		api.POST("/users/:id/logout-all",
+			requirePermission("users:update"),
+			logoutAll)
+
+		// ปลดล็อค login ที่ถูกล็อคจากการใส่รหัสผิดหลายครั้ง
+		api.GET("/lockouts",
+			requirePermission("users:read"),
+			listLockouts)
+
+		api.POST("/lockouts/unlock",
+			requirePermission("users:update"),
+			unlockLogin)
+
+		// Roles & permissions endpoints (admin)
+		api.GET("/roles",
+			requirePermission("roles:read"),
+			listRoles)
+
+		api.GET("/roles/:id",
+			requirePermission("roles:read"),
+			getRole)
+
+		api.POST("/roles",
+			requirePermission("roles:create"),
+			createRole)
+
+		api.DELETE("/roles/:id",
+			requirePermission("roles:delete"),
+			deleteRole)
+
+		api.POST("/roles/:id/permissions",
+			requirePermission("roles:update"),
+			attachPermission)
+
+		api.DELETE("/roles/:id/permissions/:permission",
+			requirePermission("roles:update"),
+			detachPermission)
+
+		api.GET("/permissions",
+			requirePermission("roles:read"),
+			listPermissions)
+
+		// ดู/export audit log (?format=csv หรือ ndjson)
+		api.GET("/audit-logs",
+			requirePermission("audit:read"),
+			listAuditLogs)
+
+		api.GET("/audit-logs/verify",
+			requirePermission("audit:read"),
+			verifyAuditLogs)
+
+		// Metrics ของ audit pipeline (queue depth, dropped ฯลฯ) Prometheus scrape ด้วย API key ที่มี audit:read
+		api.GET("/metrics",
+			requirePermission("audit:read"),
+			auditMetricsHandler)
+
+		// สรุปเหตุการณ์น่าสงสัยตาม IP / account (?since=24h)
+		api.GET("/security/summary",
+			requirePermission("audit:read"),
+			securitySummary)
+
+		api.GET("/users/:id/permissions/explain",
+			requirePermission("roles:read"),
+			explainPermission)
+
+		api.POST("/users/:id/roles",
+			requirePermission("roles:assign"),
+			assignRole)
+
+		api.DELETE("/users/:id/roles/:role",
+			requirePermission("roles:assign"),
+			unassignRole)
+
+		// บังคับ MFA ราย role
+		api.PUT("/roles/:id/mfa",
+			requirePermission("roles:update"),
+			setRoleMFARequirement)
 	}
 
-	r.Run(":8080")
+	srv := &http.Server{Addr: ":8080", Handler: r}
+	go func() {
+		if err := srv.ListenAndServe(); err != nil && err != http.ErrServerClosed {
+			log.Fatal("failed to start server: ", err)
+		}
+	}()
+
+	// รอ SIGINT/SIGTERM แล้วปิดแบบ graceful: รอ request ที่ค้างอยู่ จากนั้น flush audit queue
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
+	<-quit
+	log.Println("shutting down server...")
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := srv.Shutdown(ctx); err != nil {
+		log.Printf("Error shutting down server: %v", err)
+	}
+	auditLog.Close()
 }
\ No newline at end of file
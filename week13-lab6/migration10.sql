@@ -0,0 +1,4 @@
+-- 13. Session / Device Information (refresh token หนึ่งแถว = หนึ่ง session)
+ALTER TABLE refresh_tokens ADD COLUMN user_agent TEXT;
+ALTER TABLE refresh_tokens ADD COLUMN ip_address VARCHAR(50);
+ALTER TABLE refresh_tokens ADD COLUMN last_used_at TIMESTAMP;
@@ -0,0 +1,43 @@
+-- 14. Permission Change Notifications (LISTEN/NOTIFY)
+-- แจ้งทุก replica ให้ล้าง permission cache เมื่อ role/permission เปลี่ยน
+-- payload = user_id ที่ได้รับผลกระทบ หรือ '*' = ล้างทั้งหมด
+CREATE OR REPLACE FUNCTION notify_user_roles_changed()
+RETURNS TRIGGER AS $$
+BEGIN
+    IF TG_OP IN ('UPDATE', 'DELETE') THEN
+        PERFORM pg_notify('permissions_changed', OLD.user_id::text);
+    END IF;
+    IF TG_OP IN ('INSERT', 'UPDATE') THEN
+        PERFORM pg_notify('permissions_changed', NEW.user_id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE OR REPLACE FUNCTION notify_all_permissions_changed()
+RETURNS TRIGGER AS $$
+BEGIN
+    PERFORM pg_notify('permissions_changed', '*');
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER user_roles_permissions_changed
+AFTER INSERT OR UPDATE OR DELETE ON user_roles
+FOR EACH ROW
+EXECUTE FUNCTION notify_user_roles_changed();
+
+CREATE TRIGGER role_permissions_changed
+AFTER INSERT OR UPDATE OR DELETE OR TRUNCATE ON role_permissions
+FOR EACH STATEMENT
+EXECUTE FUNCTION notify_all_permissions_changed();
+
+CREATE TRIGGER roles_permissions_changed
+AFTER UPDATE OR DELETE ON roles
+FOR EACH STATEMENT
+EXECUTE FUNCTION notify_all_permissions_changed();
+
+CREATE TRIGGER permissions_changed
+AFTER UPDATE OR DELETE ON permissions
+FOR EACH STATEMENT
+EXECUTE FUNCTION notify_all_permissions_changed();
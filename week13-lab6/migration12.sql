@@ -0,0 +1,17 @@
+-- 15. Wildcard Permissions
+-- รูปแบบ resource:action โดยใช้ * แทนได้ทั้งสองฝั่ง เช่น books:* หรือ *:read
+INSERT INTO permissions (name, description, resource, action) VALUES
+('*:*', 'Full access to every resource', '*', '*'),
+('books:*', 'Full access to books', 'books', '*'),
+('users:*', 'Full access to users', 'users', '*'),
+('roles:*', 'Full access to roles', 'roles', '*'),
+('*:read', 'Read access to every resource', '*', 'read');
+
+-- Admin: ใช้ *:* แทนการต้องมีทุกแถว (permission ใหม่ในอนาคตก็ได้อัตโนมัติ)
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT
+    (SELECT id FROM roles WHERE name = 'admin'),
+    id
+FROM permissions
+WHERE name = '*:*'
+ON CONFLICT DO NOTHING;
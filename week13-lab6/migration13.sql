@@ -0,0 +1,15 @@
+-- 16. Book Ownership (ใครเป็นคนสร้างหนังสือ)
+ALTER TABLE books ADD COLUMN created_by INTEGER REFERENCES users(id) ON DELETE SET NULL;
+
+CREATE INDEX idx_books_created_by ON books(created_by);
+
+-- แก้ไข/ลบหนังสือของคนอื่นได้ (ไม่มี = แก้ได้เฉพาะที่ตัวเองสร้าง)
+INSERT INTO permissions (name, description, resource, action) VALUES
+('books:manage_all', 'Can update or delete books created by anyone', 'books', 'manage_all');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT
+    (SELECT id FROM roles WHERE name = 'admin'),
+    id
+FROM permissions
+WHERE name = 'books:manage_all';
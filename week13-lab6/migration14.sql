@@ -0,0 +1,15 @@
+-- 17. API Keys / Personal Access Tokens (สำหรับ script และ integration)
+CREATE TABLE api_keys (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    name VARCHAR(100) NOT NULL,
+    key_prefix VARCHAR(16) NOT NULL,           -- ส่วนต้นของ key ไว้แสดงให้ผู้ใช้จำได้ เช่น pat_1a2b3c4d
+    key_hash VARCHAR(64) UNIQUE NOT NULL,      -- SHA-256 ของ key (ไม่เก็บ key จริง)
+    scopes TEXT[] NOT NULL,                    -- permission ที่ key นี้ใช้ได้ (ต้องเป็นส่วนหนึ่งของสิทธิ์เจ้าของ)
+    expires_at TIMESTAMP,                      -- NULL = ไม่หมดอายุ
+    last_used_at TIMESTAMP,
+    revoked_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_api_keys_user ON api_keys(user_id);
@@ -0,0 +1,13 @@
+-- 18. Audit Log Query / Export
+INSERT INTO permissions (name, description, resource, action) VALUES
+('audit:read', 'Can query and export audit logs', 'audit', 'read');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT
+    (SELECT id FROM roles WHERE name = 'admin'),
+    id
+FROM permissions
+WHERE name = 'audit:read';
+
+-- filter ที่ใช้บ่อยนอกเหนือจาก user/action/created_at (มี index อยู่แล้วใน migration4)
+CREATE INDEX idx_audit_logs_resource ON audit_logs(resource, resource_id);
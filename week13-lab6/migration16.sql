@@ -0,0 +1,16 @@
+-- 19. Tamper-evident Audit Log (hash chain + signed checkpoints)
+-- hash = SHA-256 ของ record ที่ canonicalize แล้ว (รวม prev_hash) แถวที่มีอยู่ก่อนหน้านี้ไม่อยู่ใน chain
+ALTER TABLE audit_logs ADD COLUMN prev_hash VARCHAR(64);
+ALTER TABLE audit_logs ADD COLUMN hash VARCHAR(64);
+
+CREATE INDEX idx_audit_logs_hash ON audit_logs(id) WHERE hash IS NOT NULL;
+
+-- checkpoint = JWS ที่เซ็นด้วย JWT signing key (ตรวจได้จาก /.well-known/jwks.json)
+-- ใช้พิสูจน์ว่า ณ เวลานั้น chain ยาวถึงแถวไหนและ hash เป็นอะไร (กันการตัดแถวท้ายทิ้ง)
+CREATE TABLE audit_checkpoints (
+    id SERIAL PRIMARY KEY,
+    last_log_id INTEGER NOT NULL,
+    last_hash VARCHAR(64) NOT NULL,
+    signature TEXT NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
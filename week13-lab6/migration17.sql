@@ -0,0 +1,13 @@
+-- 20. Password History (ห้ามใช้รหัสผ่านซ้ำกับ N ครั้งล่าสุด)
+CREATE TABLE password_history (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    password_hash VARCHAR(255) NOT NULL,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_password_history_user ON password_history(user_id, created_at DESC);
+
+-- รหัสผ่านปัจจุบันของทุกคนนับเป็นประวัติครั้งแรก
+INSERT INTO password_history (user_id, password_hash)
+SELECT id, password_hash FROM users;
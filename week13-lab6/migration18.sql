@@ -0,0 +1,10 @@
+-- 21. Impersonation (support เข้าดูระบบในมุมของลูกค้า)
+INSERT INTO permissions (name, description, resource, action) VALUES
+('users:impersonate', 'Can act as another (non-admin) user', 'users', 'impersonate');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT
+    (SELECT id FROM roles WHERE name = 'admin'),
+    id
+FROM permissions
+WHERE name = 'users:impersonate';
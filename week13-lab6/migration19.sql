@@ -0,0 +1,10 @@
+-- 22. roles:update (แก้ไขการตั้งค่าของ role เช่น บังคับ MFA แยกจากการสร้าง role)
+INSERT INTO permissions (name, description, resource, action) VALUES
+('roles:update', 'Can change role settings such as MFA requirement', 'roles', 'update');
+
+INSERT INTO role_permissions (role_id, permission_id)
+SELECT
+    (SELECT id FROM roles WHERE name = 'admin'),
+    id
+FROM permissions
+WHERE name = 'roles:update';
@@ -0,0 +1,12 @@
+-- 8. Email Verification Tokens (สำหรับยืนยันอีเมลหลังสมัครสมาชิก)
+CREATE TABLE email_verification_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,  -- SHA-256 ของ token (ไม่เก็บ token จริง)
+    expires_at TIMESTAMP NOT NULL,
+    used_at TIMESTAMP,                       -- ใช้ได้ครั้งเดียว
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_email_verification_user ON email_verification_tokens(user_id);
+CREATE INDEX idx_email_verification_expires ON email_verification_tokens(expires_at);
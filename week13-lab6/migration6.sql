@@ -0,0 +1,12 @@
+-- 9. Password Reset Tokens (สำหรับลืมรหัสผ่าน)
+CREATE TABLE password_reset_tokens (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    token_hash VARCHAR(64) UNIQUE NOT NULL,  -- SHA-256 ของ token (ไม่เก็บ token จริง)
+    expires_at TIMESTAMP NOT NULL,           -- อายุสั้น (30 นาที)
+    used_at TIMESTAMP,                       -- ใช้ได้ครั้งเดียว
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_password_reset_user ON password_reset_tokens(user_id);
+CREATE INDEX idx_password_reset_expires ON password_reset_tokens(expires_at);
@@ -0,0 +1,22 @@
+-- 11. TOTP Two-Factor Authentication (RFC 6238)
+CREATE TABLE user_mfa (
+    user_id INTEGER PRIMARY KEY REFERENCES users(id) ON DELETE CASCADE,
+    secret_encrypted TEXT NOT NULL,      -- TOTP secret เข้ารหัสด้วย AES-GCM (MFA_ENCRYPTION_KEY)
+    enabled_at TIMESTAMP,                -- NULL = ยังไม่ได้ยืนยันการลงทะเบียน
+    last_used_step BIGINT DEFAULT 0,     -- time step ล่าสุดที่ใช้ไปแล้ว (กัน replay)
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+-- Recovery codes (เก็บแค่ SHA-256, ใช้ได้ครั้งเดียว)
+CREATE TABLE mfa_recovery_codes (
+    id SERIAL PRIMARY KEY,
+    user_id INTEGER NOT NULL REFERENCES users(id) ON DELETE CASCADE,
+    code_hash VARCHAR(64) NOT NULL,
+    used_at TIMESTAMP,
+    created_at TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE INDEX idx_mfa_recovery_user ON mfa_recovery_codes(user_id);
+
+-- บังคับ MFA ราย role (เช่น UPDATE roles SET require_mfa = true WHERE name = 'admin')
+ALTER TABLE roles ADD COLUMN require_mfa BOOLEAN DEFAULT false;
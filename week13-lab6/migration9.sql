@@ -0,0 +1,13 @@
+-- 12. Login Attempts (กัน brute-force, ใช้ร่วมกันทั้ง week13-lab6 และ week13-assignment)
+-- เก็บจำนวนครั้งที่ login ผิดแยกตาม username และ IP
+CREATE TABLE login_attempts (
+    key_type VARCHAR(10) NOT NULL,        -- 'username' หรือ 'ip'
+    key_value VARCHAR(100) NOT NULL,
+    failed_count INTEGER NOT NULL DEFAULT 0,
+    first_failed_at TIMESTAMP,
+    last_failed_at TIMESTAMP,
+    locked_until TIMESTAMP,               -- ถูกล็อคชั่วคราวจนถึงเวลานี้
+    PRIMARY KEY (key_type, key_value)
+);
+
+CREATE INDEX idx_login_attempts_locked ON login_attempts(locked_until);
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func TestValidatePassword(t *testing.T) {
+	origMinLength, origBlocklist := passwordPolicy.MinLength, passwordPolicy.Blocklist
+	passwordPolicy.MinLength = 8
+	passwordPolicy.Blocklist = map[string]bool{"password123": true, "qwertyuiop": true}
+	defer func() { passwordPolicy.MinLength, passwordPolicy.Blocklist = origMinLength, origBlocklist }()
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"long enough", "correct horse", false},
+		{"exactly min length", "abcd1234", false},
+		{"too short", "abc123", true},
+		{"thai counted by rune", "รหัสผ่านยาว", false},
+		{"short thai", "รหัส", true},
+		{"72 bytes", strings.Repeat("a", 72), false},
+		{"over 72 bytes", strings.Repeat("a", 73), true},
+		{"blocklisted", "password123", true},
+		{"blocklist ignores case", "QwertyUiop", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := validatePassword(tt.password); (err != nil) != tt.wantErr {
+				t.Errorf("validatePassword(%q) error = %v, wantErr %v", tt.password, err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func TestNeedsRehash(t *testing.T) {
+	origCost := bcryptCost
+	bcryptCost = bcrypt.MinCost + 1
+	defer func() { bcryptCost = origCost }()
+
+	hashAt := func(cost int) string {
+		hash, err := bcrypt.GenerateFromPassword([]byte("secret"), cost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(hash)
+	}
+
+	tests := []struct {
+		name string
+		hash string
+		want bool
+	}{
+		{"lower cost", hashAt(bcrypt.MinCost), true},
+		{"current cost", hashAt(bcrypt.MinCost + 1), false},
+		{"higher cost", hashAt(bcrypt.MinCost + 2), false},
+		{"not bcrypt", "5f4dcc3b5aa765d61d8327deb882cf99", true},
+		{"empty", "", true},
+	}
+
+	for _, tt := range tests {
+		if got := needsRehash(tt.hash); got != tt.want {
+			t.Errorf("needsRehash(%s) = %v, want %v", tt.name, got, tt.want)
+		}
+	}
+}
@@ -0,0 +1,51 @@
+package main
+
+import "testing"
+
+func TestMatchPermission(t *testing.T) {
+	tests := []struct {
+		grant, required string
+		want            bool
+	}{
+		{"books:read", "books:read", true},
+		{"books:*", "books:delete", true},
+		{"*:read", "users:read", true},
+		{"*:*", "roles:assign", true},
+		{"books:read", "books:update", false},
+		{"books:*", "users:read", false},
+		{"*:read", "users:update", false},
+		{"books", "books:read", false},
+		{"bookstore:read", "books:read", false},
+	}
+
+	for _, tt := range tests {
+		if got := matchPermission(tt.grant, tt.required); got != tt.want {
+			t.Errorf("matchPermission(%q, %q) = %v, want %v", tt.grant, tt.required, got, tt.want)
+		}
+	}
+}
+
+func TestExplainGrant(t *testing.T) {
+	tests := []struct {
+		grant, required string
+		wantReason      string
+		wantOK          bool
+	}{
+		{"books:read", "books:read", "exact match", true},
+		{"books:*", "books:read", "wildcard match", true},
+		{"*:*", "users:delete", "wildcard match", true},
+		{"books:update", "books:read", "implied by books:update", true},
+		{"books:delete", "books:read", "implied by books:delete", true},
+		{"roles:assign", "roles:read", "implied by roles:assign", true},
+		{"books:read", "books:update", "", false},
+		{"books:update", "books:delete", "", false},
+		{"users:update", "books:read", "", false},
+	}
+
+	for _, tt := range tests {
+		reason, ok := explainGrant(tt.grant, tt.required)
+		if reason != tt.wantReason || ok != tt.wantOK {
+			t.Errorf("explainGrant(%q, %q) = (%q, %v), want (%q, %v)", tt.grant, tt.required, reason, ok, tt.wantReason, tt.wantOK)
+		}
+	}
+}
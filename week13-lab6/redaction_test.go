@@ -0,0 +1,63 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/gin-gonic/gin"
+)
+
+func TestRedactErrorResponses(t *testing.T) {
+	gin.SetMode(gin.TestMode)
+	t.Setenv("REDACT_FIELDS", "")
+	t.Setenv("REDACT_PATTERNS", "")
+	initRedaction()
+
+	mfaToken, err := generateMFAChallengeToken(1, "alice", "mfa_enroll")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	r := gin.New()
+	r.Use(redactErrorResponses())
+	r.POST("/login", func(c *gin.Context) {
+		c.JSON(http.StatusForbidden, gin.H{"error": "mfa enrollment required", "mfa_token": mfaToken})
+	})
+	r.GET("/fail", func(c *gin.Context) {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "dial failed: password=hunter2"})
+	})
+
+	t.Run("403 mfa_enroll keeps token", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/login", nil))
+
+		var body struct {
+			MFAToken string `json:"mfa_token"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &body); err != nil {
+			t.Fatalf("decode body %q: %v", w.Body.String(), err)
+		}
+		if body.MFAToken != mfaToken {
+			t.Fatalf("mfa_token = %q, want the issued token", body.MFAToken)
+		}
+		claims, err := verifyToken(body.MFAToken)
+		if err != nil {
+			t.Fatalf("verifyToken(mfa_token) error = %v", err)
+		}
+		if claims.Purpose != "mfa_enroll" || claims.UserID != 1 {
+			t.Errorf("claims = (%q, %d), want (mfa_enroll, 1)", claims.Purpose, claims.UserID)
+		}
+	})
+
+	t.Run("500 body is redacted", func(t *testing.T) {
+		w := httptest.NewRecorder()
+		r.ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/fail", nil))
+
+		want := `{"error":"dial failed: password=[REDACTED]"}`
+		if got := w.Body.String(); got != want {
+			t.Errorf("body = %s, want %s", got, want)
+		}
+	})
+}
@@ -0,0 +1,53 @@
+package main
+
+import (
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestEventThrottleAllow(t *testing.T) {
+	throttle := newEventThrottle(time.Minute)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	tests := []struct {
+		name           string
+		key            string
+		at             time.Duration
+		wantAllowed    bool
+		wantSuppressed int
+	}{
+		{"first event", "1.2.3.4|token_invalid", 0, true, 0},
+		{"same window", "1.2.3.4|token_invalid", 10 * time.Second, false, 0},
+		{"end of window", "1.2.3.4|token_invalid", 59 * time.Second, false, 0},
+		{"other key", "5.6.7.8|token_invalid", 30 * time.Second, true, 0},
+		{"rollover carries suppressed", "1.2.3.4|token_invalid", time.Minute, true, 2},
+		{"new window", "1.2.3.4|token_invalid", time.Minute + time.Second, false, 0},
+		{"later window carries only its own count", "1.2.3.4|token_invalid", 5 * time.Minute, true, 1},
+		{"quiet window", "1.2.3.4|token_invalid", 10 * time.Minute, true, 0},
+	}
+
+	for _, tt := range tests {
+		allowed, suppressed := throttle.allow(tt.key, start.Add(tt.at))
+		if allowed != tt.wantAllowed || suppressed != tt.wantSuppressed {
+			t.Errorf("%s: allow(%q) = (%v, %d), want (%v, %d)", tt.name, tt.key, allowed, suppressed, tt.wantAllowed, tt.wantSuppressed)
+		}
+	}
+}
+
+func TestEventThrottleEvictsExpiredEntries(t *testing.T) {
+	throttle := newEventThrottle(time.Minute)
+	start := time.Date(2026, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	for i := 0; i < eventThrottleMaxEntries; i++ {
+		throttle.allow(strconv.Itoa(i), start)
+	}
+	throttle.allow("fresh", start.Add(30*time.Second))
+
+	if allowed, _ := throttle.allow("new", start.Add(time.Minute)); !allowed {
+		t.Fatal("allow() for a new key = false, want true")
+	}
+	if got := len(throttle.entries); got != 2 {
+		t.Errorf("entries after eviction = %d, want 2 (fresh and new)", got)
+	}
+}
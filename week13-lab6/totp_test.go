@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// RFC 6238 Appendix B (SHA-1) ตัดเหลือ 6 หลักท้าย
+var rfc6238Secret = []byte("12345678901234567890")
+
+func TestTOTPCode(t *testing.T) {
+	tests := []struct {
+		unix int64
+		want string
+	}{
+		{59, "287082"},
+		{1111111109, "081804"},
+		{1111111111, "050471"},
+		{1234567890, "005924"},
+		{2000000000, "279037"},
+		{20000000000, "353130"},
+	}
+
+	for _, tt := range tests {
+		if got := totpCode(rfc6238Secret, uint64(tt.unix/totpPeriod)); got != tt.want {
+			t.Errorf("totpCode(t=%d) = %s, want %s", tt.unix, got, tt.want)
+		}
+	}
+}
+
+func TestValidateTOTP(t *testing.T) {
+	now := time.Unix(1111111111, 0)
+	step := now.Unix() / totpPeriod
+
+	tests := []struct {
+		name     string
+		code     string
+		wantStep int64
+		wantOK   bool
+	}{
+		{"current step", totpCode(rfc6238Secret, uint64(step)), step, true},
+		{"previous step within skew", totpCode(rfc6238Secret, uint64(step-1)), step - 1, true},
+		{"next step within skew", totpCode(rfc6238Secret, uint64(step+1)), step + 1, true},
+		{"two steps old", totpCode(rfc6238Secret, uint64(step-2)), 0, false},
+		{"two steps ahead", totpCode(rfc6238Secret, uint64(step+2)), 0, false},
+		{"wrong code", "000000", 0, false},
+		{"empty code", "", 0, false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			gotStep, gotOK := validateTOTP(rfc6238Secret, tt.code, now)
+			if gotOK != tt.wantOK || gotStep != tt.wantStep {
+				t.Errorf("validateTOTP(%q) = (%d, %v), want (%d, %v)", tt.code, gotStep, gotOK, tt.wantStep, tt.wantOK)
+			}
+		})
+	}
+}
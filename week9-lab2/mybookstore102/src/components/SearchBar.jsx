@@ -1,24 +1,75 @@
-import React, { useState } from 'react';
+import React, { useState, useEffect } from 'react';
 import { SearchIcon } from '@heroicons/react/outline';
 
 const SearchBar = ({ onSearch, placeholder = "ค้นหาหนังสือ..." }) => {
   const [searchTerm, setSearchTerm] = useState('');
+  const [suggestions, setSuggestions] = useState([]);
+  const [showSuggestions, setShowSuggestions] = useState(false);
 
-  const handleSubmit = (e) => {
-    e.preventDefault();
+  // ดึงคำแนะนำจาก API หลังหยุดพิมพ์ 200ms (ไม่ยิง request ทุกตัวอักษร)
+  useEffect(() => {
+    const term = searchTerm.trim();
+    if (!term) {
+      setSuggestions([]);
+      return;
+    }
+
+    const controller = new AbortController();
+    const timer = setTimeout(async () => {
+      try {
+        const response = await fetch(
+          `/api/v1/books/suggest?q=${encodeURIComponent(term)}`,
+          { signal: controller.signal }
+        );
+        if (!response.ok) {
+          throw new Error('Failed to fetch suggestions');
+        }
+        setSuggestions(await response.json());
+      } catch (err) {
+        if (err.name !== 'AbortError') {
+          setSuggestions([]);
+        }
+      }
+    }, 200);
+
+    return () => {
+      clearTimeout(timer);
+      controller.abort();
+    };
+  }, [searchTerm]);
+
+  const submitSearch = (term) => {
+    setShowSuggestions(false);
     if (onSearch) {
-      onSearch(searchTerm);
+      onSearch(term);
     }
   };
 
+  const handleSubmit = (e) => {
+    e.preventDefault();
+    submitSearch(searchTerm);
+  };
+
+  const handleSelect = (suggestion) => {
+    setSearchTerm(suggestion.value);
+    submitSearch(suggestion.value);
+  };
+
   return (
     <form onSubmit={handleSubmit} className="relative">
       <div className="relative">
         <input
           type="text"
           value={searchTerm}
-          onChange={(e) => setSearchTerm(e.target.value)}
+          onChange={(e) => {
+            setSearchTerm(e.target.value);
+            setShowSuggestions(true);
+          }}
+          onFocus={() => setShowSuggestions(true)}
+          // หน่วงไว้ให้ onMouseDown ของรายการคำแนะนำทำงานก่อน
+          onBlur={() => setTimeout(() => setShowSuggestions(false), 100)}
           placeholder={placeholder}
+          autoComplete="off"
           className="w-full pl-10 pr-4 py-3 border border-gray-300 rounded-lg 
             focus:outline-none focus:ring-2 focus:ring-viridian-500 focus:border-transparent
             placeholder-gray-400 transition-all duration-200"
@@ -34,6 +85,25 @@ const SearchBar = ({ onSearch, placeholder = "ค้นหาหนังสื
           ค้นหา
         </button>
       </div>
+
+      {showSuggestions && suggestions.length > 0 && (
+        <ul className="absolute z-10 w-full mt-1 bg-white border border-gray-200
+          rounded-lg shadow-lg overflow-hidden">
+          {suggestions.map((suggestion) => (
+            <li
+              key={`${suggestion.type}-${suggestion.value}`}
+              onMouseDown={() => handleSelect(suggestion)}
+              className="flex items-center justify-between px-4 py-2 cursor-pointer
+                hover:bg-viridian-50"
+            >
+              <span className="text-gray-800 truncate">{suggestion.value}</span>
+              <span className="ml-3 text-xs text-gray-400">
+                {suggestion.type === 'author' ? 'ผู้แต่ง' : 'ชื่อหนังสือ'}
+              </span>
+            </li>
+          ))}
+        </ul>
+      )}
     </form>
   );
 };